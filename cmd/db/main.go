@@ -2,10 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/datastore"
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
@@ -19,24 +26,166 @@ type GetResponse struct {
 
 type PutRequest struct {
 	Value json.RawMessage `json:"value"`
+	// TTL is the number of seconds after which the value expires. Zero
+	// keeps the value forever.
+	TTL int64 `json:"ttl,omitempty"`
 }
 
+// Int64Response is returned for values read with type=int64 and by
+// increments, carrying the value as a JSON number.
+type Int64Response struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+type IncrementRequest struct {
+	// Delta defaults to 1 when omitted.
+	Delta *int64 `json:"delta,omitempty"`
+}
+
+type BatchOp struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+type ListResponse struct {
+	Items  []GetResponse `json:"items"`
+	Cursor string        `json:"cursor,omitempty"`
+}
+
+// StatsResponse is returned by GET /admin/stats.
+type StatsResponse struct {
+	Keys          int             `json:"keys"`
+	SegmentCount  int             `json:"segment_count"`
+	Segments      []SegmentStats  `json:"segments"`
+	LiveBytes     int64           `json:"live_bytes"`
+	GarbageBytes  int64           `json:"garbage_bytes"`
+	PendingWrites int             `json:"pending_writes"`
+	GetWorkers    GetWorkerStats  `json:"get_workers"`
+	Compaction    CompactionStats `json:"compaction"`
+	Ops           OpStats         `json:"ops"`
+	Cache         CacheStats      `json:"cache"`
+}
+
+type SegmentStats struct {
+	Num       int   `json:"num"`
+	Size      int64 `json:"size"`
+	LiveBytes int64 `json:"live_bytes"`
+	Active    bool  `json:"active,omitempty"`
+}
+
+type GetWorkerStats struct {
+	Total int `json:"total"`
+	Busy  int `json:"busy"`
+}
+
+type CompactionStats struct {
+	Running bool `json:"running"`
+	// LastStarted is omitted until the first compaction starts.
+	LastStarted  *time.Time `json:"last_started,omitempty"`
+	LastDuration float64    `json:"last_duration_seconds"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+type OpStats struct {
+	Gets         uint64 `json:"gets"`
+	Scans        uint64 `json:"scans"`
+	Puts         uint64 `json:"puts"`
+	Deletes      uint64 `json:"deletes"`
+	Batches      uint64 `json:"batches"`
+	Increments   uint64 `json:"increments"`
+	FailedWrites uint64 `json:"failed_writes"`
+}
+
+// BackupResponse is returned by POST /admin/backup.
+type BackupResponse struct {
+	Dir string `json:"dir"`
+}
+
+// ImportResponse is returned by POST /admin/import.
+type ImportResponse struct {
+	Imported int `json:"imported"`
+}
+
+type CacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+const (
+	batchKey         = "_batch"
+	incrSuffix       = "/incr"
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	encryptionKeysEnv = "DB_ENCRYPTION_KEYS"
+)
+
 var (
 	port           = flag.Int("port", 8080, "db server port")
 	dbDir          = flag.String("db-dir", "/data/db", "directory for database files")
+	backupDir      = flag.String("backup-dir", "/data/backup", "directory POST /admin/backup writes checkpoints into, one subdirectory each; sealed segments are hard-linked when it is on the same mount as -db-dir and copied otherwise")
 	maxSegmentSize = flag.Int64("max-segment-size", 10*1024*1024, "maximum segment size in bytes")
+	getWorkers     = flag.Int("get-workers", 0, "number of goroutines reading values, 0 uses twice the number of CPUs")
+	queueDepth     = flag.Int("queue-depth", 0, "number of writes that can wait for the writer, 0 uses the default")
+	readOnly       = flag.Bool("read-only", false, "serve an existing database without writing to it")
+	syncPolicy     = flag.String("sync", "always", "when writes are flushed to disk: always, interval or never")
+	syncInterval   = flag.Duration("sync-interval", time.Second, "flush period for -sync=interval")
+	compressMin    = flag.Int("compress-threshold", 0, "compress values of at least this many bytes, 0 disables compression")
+	cacheSize      = flag.Int64("cache-size", 16*1024*1024, "bytes of recently read keys and values kept in memory, 0 disables the cache")
+	diskIndex      = flag.Bool("disk-index", false, "keep only the keys of the active segment in memory and look older ones up in key files")
+	garbageRatio   = flag.Float64("compact-garbage-ratio", 0.5, "compact once this share of sealed segment bytes is garbage, 0 disables the check")
+	maxSegments    = flag.Int("compact-max-segments", 16, "compact once there are more sealed segments than this, 0 disables the check")
+	compactEvery   = flag.Duration("compact-min-interval", time.Minute, "minimum time between automatic compactions")
+	keyFile        = flag.String("encryption-key-file", "", "file with encryption keys as <id>:<hex key> entries; defaults to the "+encryptionKeysEnv+" environment variable")
 )
 
 func main() {
 	flag.Parse()
 
-	log.Printf("Starting DB server on port %d, DB directory %s, max segment size %d bytes", *port, *dbDir, *maxSegmentSize)
+	policy, err := datastore.ParseSyncPolicy(*syncPolicy)
+	if err != nil {
+		log.Fatalf("Invalid -sync flag: %v", err)
+	}
 
-	db, err := datastore.Open(*dbDir, *maxSegmentSize)
+	keys, err := loadEncryptionKeys()
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+
+	log.Printf("Starting DB server on port %d, DB directory %s, max segment size %d bytes, sync policy %s, %d encryption keys, read-only %t", *port, *dbDir, *maxSegmentSize, policy, len(keys), *readOnly)
+
+	db, err := datastore.OpenWithOptions(*dbDir, datastore.Options{
+		MaxSegmentSize:    *maxSegmentSize,
+		GetWorkers:        *getWorkers,
+		QueueDepth:        *queueDepth,
+		SyncPolicy:        policy,
+		SyncInterval:      *syncInterval,
+		CompressThreshold: *compressMin,
+		CacheSize:         *cacheSize,
+		DiskIndex:         *diskIndex,
+		EncryptionKeys:    keys,
+		Compaction: datastore.CompactionPolicy{
+			GarbageRatio: *garbageRatio,
+			MaxSegments:  *maxSegments,
+			MinInterval:  *compactEvery,
+		},
+		Logger:   log.Default(),
+		ReadOnly: *readOnly,
+	})
 	if err != nil {
 		log.Fatalf("Failed to open datastore: %v", err)
 	}
 	defer func() {
+		stats := db.CacheStats()
+		log.Printf("Value cache: %d hits, %d misses", stats.Hits, stats.Misses)
 		if err := db.Close(); err != nil {
 			log.Printf("Error closing datastore: %v", err)
 		}
@@ -55,16 +204,30 @@ func main() {
 			http.Error(rw, "Key is required for /db/<key>", http.StatusBadRequest)
 			return
 		}
+		if key == batchKey {
+			handleBatch(db, rw, r)
+			return
+		}
+		// Only POST increments, so that keys ending in /incr can still be
+		// read.
+		if counterKey, ok := strings.CutSuffix(key, incrSuffix); ok && counterKey != "" && r.Method == http.MethodPost {
+			handleIncrement(db, counterKey, rw, r)
+			return
+		}
 
 		switch r.Method {
 		case http.MethodGet:
 			valueType := r.URL.Query().Get("type")
 
-			value, err := db.Get(key)
+			value, version, err := db.GetVersioned(key)
 			if err != nil {
 				if err == datastore.ErrNotFound {
 					log.Printf("GET: Key '%s' not found, returning 404", key)
 					rw.WriteHeader(http.StatusNotFound)
+				} else if errors.Is(err, datastore.ErrCorrupted) {
+					log.Printf("GET: Stored record for key '%s' is corrupted: %v", key, err)
+					rw.Header().Set("X-Error", "corrupted")
+					http.Error(rw, "Stored value is corrupted", http.StatusInternalServerError)
 				} else {
 					log.Printf("GET: Error getting key '%s' from DB: %v", key, err)
 					http.Error(rw, "Internal server error", http.StatusInternalServerError)
@@ -72,16 +235,18 @@ func main() {
 				return
 			}
 
+			var resp any = GetResponse{Key: key, Value: value}
 			if valueType == "int64" {
-				_, convErr := strconv.ParseInt(value, 10, 64)
+				n, convErr := strconv.ParseInt(value, 10, 64)
 				if convErr != nil {
 					log.Printf("GET: Value for key '%s' cannot be parsed as int64: %s (value: %s)", key, convErr, value)
 					http.Error(rw, "Value cannot be parsed as int64", http.StatusBadRequest)
 					return
 				}
+				resp = Int64Response{Key: key, Value: n}
 			}
 
-			resp := GetResponse{Key: key, Value: value}
+			rw.Header().Set("ETag", formatETag(version))
 			rw.Header().Set("Content-Type", "application/json")
 			rw.WriteHeader(http.StatusOK)
 			json.NewEncoder(rw).Encode(resp)
@@ -94,8 +259,59 @@ func main() {
 				return
 			}
 
+			if req.TTL < 0 {
+				http.Error(rw, "ttl must not be negative", http.StatusBadRequest)
+				return
+			}
+
+			ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+			if (ifMatch != "" || ifNoneMatch != "") && req.TTL > 0 {
+				http.Error(rw, "ttl cannot be combined with If-Match or If-None-Match", http.StatusBadRequest)
+				return
+			}
+			isInt64 := r.URL.Query().Get("type") == "int64"
+			if isInt64 && (ifMatch != "" || ifNoneMatch != "" || req.TTL > 0) {
+				http.Error(rw, "type=int64 cannot be combined with ttl, If-Match or If-None-Match", http.StatusBadRequest)
+				return
+			}
+
 			valueToStore := string(req.Value)
-			err = db.Put(key, valueToStore)
+			switch {
+			case isInt64:
+				var n int64
+				if err := json.Unmarshal(req.Value, &n); err != nil {
+					http.Error(rw, "Value must be an int64 number", http.StatusBadRequest)
+					return
+				}
+				err = db.PutInt64(key, n)
+			case ifMatch == "*":
+				err = db.PutIfExists(key, valueToStore)
+			case ifMatch != "":
+				version, ok := parseETag(ifMatch)
+				if !ok {
+					http.Error(rw, "If-Match must be * or a single ETag returned by GET", http.StatusBadRequest)
+					return
+				}
+				err = db.PutIfVersion(key, valueToStore, version)
+			case ifNoneMatch == "*":
+				err = db.PutIfVersion(key, valueToStore, 0)
+			case ifNoneMatch != "":
+				http.Error(rw, "If-None-Match only supports *", http.StatusBadRequest)
+				return
+			case req.TTL > 0:
+				err = db.PutWithTTL(key, valueToStore, time.Duration(req.TTL)*time.Second)
+			default:
+				err = db.Put(key, valueToStore)
+			}
+			if errors.Is(err, datastore.ErrConflict) {
+				log.Printf("POST: Precondition failed for key '%s'", key)
+				http.Error(rw, "Precondition failed", http.StatusPreconditionFailed)
+				return
+			}
+			if errors.Is(err, datastore.ErrReadOnly) {
+				http.Error(rw, "Database is read-only", http.StatusForbidden)
+				return
+			}
 			if err != nil {
 				log.Printf("POST: Error putting key '%s' into DB: %v", key, err)
 				http.Error(rw, "Internal server error", http.StatusInternalServerError)
@@ -111,10 +327,293 @@ func main() {
 	})
 
 	h.HandleFunc("/db", func(rw http.ResponseWriter, r *http.Request) {
-		http.Error(rw, "Invalid path. Use /db/<key>", http.StatusBadRequest)
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Invalid path. Use /db/<key>", http.StatusBadRequest)
+			return
+		}
+		handleList(db, rw, r)
+	})
+
+	h.HandleFunc("/admin/stats", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleStats(db, rw)
+	})
+
+	h.HandleFunc("/admin/backup", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleBackup(db, rw)
+	})
+
+	h.HandleFunc("/admin/export", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleExport(db, rw)
+	})
+
+	h.HandleFunc("/admin/import", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleImport(db, rw, r)
 	})
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// loadEncryptionKeys reads the keys from -encryption-key-file if it is set, and
+// from the environment otherwise. No keys means no encryption.
+func loadEncryptionKeys() ([]datastore.EncryptionKey, error) {
+	if *keyFile == "" {
+		return datastore.ParseEncryptionKeys(os.Getenv(encryptionKeysEnv))
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.ParseEncryptionKeys(string(data))
+}
+
+// handleIncrement serves POST /db/<key>/incr. The body is optional; without
+// it the counter is incremented by one.
+func handleIncrement(db *datastore.Db, key string, rw http.ResponseWriter, r *http.Request) {
+	var req IncrementRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("INCR: Error decoding request body: %v", err)
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	delta := int64(1)
+	if req.Delta != nil {
+		delta = *req.Delta
+	}
+
+	value, err := db.Increment(key, delta)
+	if errors.Is(err, datastore.ErrNotInt64) || errors.Is(err, datastore.ErrOverflow) {
+		log.Printf("INCR: Cannot increment key '%s': %v", key, err)
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, datastore.ErrReadOnly) {
+		http.Error(rw, "Database is read-only", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("INCR: Error incrementing key '%s': %v", key, err)
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(Int64Response{Key: key, Value: value})
+}
+
+// formatETag turns a key version into a strong ETag.
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func parseETag(etag string) (uint64, bool) {
+	etag = strings.TrimSpace(etag)
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(etag[1:len(etag)-1], 10, 64)
+	if err != nil || version == 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+func handleBatch(db *datastore.Db, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("BATCH: Error decoding request body: %v", err)
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var batch datastore.WriteBatch
+	for i, op := range req.Ops {
+		if op.Key == "" {
+			http.Error(rw, fmt.Sprintf("Operation %d has no key", i), http.StatusBadRequest)
+			return
+		}
+		switch op.Op {
+		case "put":
+			batch.Put(op.Key, string(op.Value))
+		case "delete":
+			batch.Delete(op.Key)
+		default:
+			http.Error(rw, fmt.Sprintf("Operation %d has unknown op %q, expected put or delete", i, op.Op), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := db.Write(&batch); errors.Is(err, datastore.ErrReadOnly) {
+		http.Error(rw, "Database is read-only", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("BATCH: Error writing batch of %d operations: %v", batch.Len(), err)
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("BATCH: Successfully wrote batch of %d operations", batch.Len())
+	rw.WriteHeader(http.StatusOK)
+}
+
+// handleList returns keys with the given prefix in sorted order, one page at
+// a time. The cursor of a page is its last key; the next page starts right
+// after it.
+func handleList(db *datastore.Db, rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	cursor := query.Get("cursor")
+
+	limit := defaultListLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > maxListLimit {
+			http.Error(rw, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	start := prefix
+	if cursor != "" {
+		if !strings.HasPrefix(cursor, prefix) {
+			http.Error(rw, "cursor does not match prefix", http.StatusBadRequest)
+			return
+		}
+		start = cursor + "\x00"
+	}
+
+	resp := ListResponse{Items: make([]GetResponse, 0, limit)}
+	it := db.Scan(start, datastore.PrefixEnd(prefix), limit+1)
+	defer it.Close()
+	for it.Next() {
+		if len(resp.Items) == limit {
+			resp.Cursor = resp.Items[limit-1].Key
+			break
+		}
+		resp.Items = append(resp.Items, GetResponse{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		log.Printf("LIST: Error scanning prefix '%s': %v", prefix, err)
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(resp)
+}
+
+func handleStats(db *datastore.Db, rw http.ResponseWriter) {
+	stats, err := db.Stats()
+	if err != nil {
+		log.Printf("STATS: Error collecting stats: %v", err)
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := StatsResponse{
+		Keys:          stats.Keys,
+		SegmentCount:  stats.SegmentCount,
+		Segments:      make([]SegmentStats, len(stats.Segments)),
+		LiveBytes:     stats.LiveBytes,
+		GarbageBytes:  stats.GarbageBytes,
+		PendingWrites: stats.PendingWrites,
+		GetWorkers:    GetWorkerStats{Total: stats.GetWorkers, Busy: stats.BusyGetWorkers},
+		Compaction: CompactionStats{
+			Running:      stats.Compaction.Running,
+			LastDuration: stats.Compaction.LastDuration.Seconds(),
+			LastError:    stats.Compaction.LastError,
+		},
+		Ops:   OpStats(stats.Ops),
+		Cache: CacheStats(stats.Cache),
+	}
+	for i, seg := range stats.Segments {
+		resp.Segments[i] = SegmentStats(seg)
+	}
+	if started := stats.Compaction.LastStarted; !started.IsZero() {
+		resp.Compaction.LastStarted = &started
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// handleBackup checkpoints the database into a new subdirectory of
+// -backup-dir named after the current time.
+func handleBackup(db *datastore.Db, rw http.ResponseWriter) {
+	dir := filepath.Join(*backupDir, "backup-"+time.Now().UTC().Format("20060102-150405.000000000"))
+	start := time.Now()
+	if err := db.Checkpoint(dir); err != nil {
+		log.Printf("BACKUP: Error writing checkpoint to %s: %v", dir, err)
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("BACKUP: Wrote checkpoint to %s in %v", dir, time.Since(start))
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(BackupResponse{Dir: dir})
+}
+
+// handleExport streams all keys as JSON Lines. The status is sent before the
+// first key is read, so a failure part way aborts the connection rather than
+// ending the response as if the export were complete.
+func handleExport(db *datastore.Db, rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	count, err := db.Export(rw)
+	if err != nil {
+		log.Printf("EXPORT: Error after exporting %d keys: %v", count, err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("EXPORT: Exported %d keys", count)
+}
+
+// handleImport stores the keys of a JSON Lines export read from the request
+// body as it arrives.
+func handleImport(db *datastore.Db, rw http.ResponseWriter, r *http.Request) {
+	count, err := db.Import(r.Body)
+	switch {
+	case errors.Is(err, datastore.ErrInvalidImport):
+		log.Printf("IMPORT: Invalid input after importing %d keys: %v", count, err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, datastore.ErrReadOnly):
+		http.Error(rw, "Database is read-only", http.StatusForbidden)
+		return
+	case err != nil:
+		log.Printf("IMPORT: Error after importing %d keys: %v", count, err)
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("IMPORT: Imported %d keys", count)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(ImportResponse{Imported: count})
+}
@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// CompactionPolicy decides when the database compacts itself. Only sealed
+// segments are compacted, so both thresholds look at those alone.
+type CompactionPolicy struct {
+	// GarbageRatio starts a compaction once at least this share of the bytes
+	// in sealed segments belongs to overwritten or deleted records. Records
+	// that have merely expired only count once Open or a compaction has
+	// dropped them, so data that mostly expires rather than being
+	// overwritten is better compacted by MaxSegments. Zero turns the check
+	// off.
+	GarbageRatio float64
+	// MaxSegments starts a compaction once there are more sealed segments
+	// than this. Zero turns the check off.
+	MaxSegments int
+	// MinInterval is the least time between the starts of two compactions.
+	MinInterval time.Duration
+}
+
+// WithAutoCompaction makes the writer start a background compaction whenever
+// the policy calls for one.
+func WithAutoCompaction(policy CompactionPolicy) Option {
+	return func(o *Options) {
+		o.Compaction = policy
+	}
+}
+
+func (o *Options) validateCompactionPolicy() error {
+	p := o.Compaction
+	if p.GarbageRatio < 0 || p.GarbageRatio > 1 {
+		return fmt.Errorf("garbage ratio must be between 0 and 1, got %v", p.GarbageRatio)
+	}
+	if p.MaxSegments < 0 {
+		return fmt.Errorf("max segments must not be negative, got %d", p.MaxSegments)
+	}
+	if p.MinInterval < 0 {
+		return fmt.Errorf("min compaction interval must not be negative, got %v", p.MinInterval)
+	}
+	return nil
+}
+
+// indexSet points the key at a new record and moves the bytes of the record it
+// replaces from live to garbage. Must be called with db.mu held.
+func (db *Db) indexSet(key string, pos SegmentPos) {
+	db.indexDelete(key)
+	db.index.set(key, pos)
+	db.addLiveBytes(pos, pos.size)
+	db.keyCount++
+}
+
+// indexDelete removes the key, turning its record into garbage, and drops its
+// cached value. Under the disk index the key may still have records in sealed
+// segments, so it is replaced by a tombstone instead. A running compaction
+// is told about the key. Must be called with db.mu held.
+func (db *Db) indexDelete(key string) {
+	db.cache.remove(key)
+	if db.compactionWrites != nil {
+		db.compactionWrites[key] = struct{}{}
+	}
+	pos, ok, err := db.lookup(key)
+	if err != nil {
+		db.logf("Failed to look up replaced record of key %s: %v", key, err)
+	}
+	if ok {
+		db.addLiveBytes(pos, -pos.size)
+		db.keyCount--
+	}
+	switch {
+	case db.opts.DiskIndex && (ok || err != nil):
+		db.index.set(key, SegmentPos{deleted: true})
+	case !db.opts.DiskIndex && ok:
+		db.index.delete(key)
+	}
+}
+
+// indexRestore puts back what the index held for a key before a write that
+// failed. Must be called with db.mu held.
+func (db *Db) indexRestore(u indexUndo) {
+	db.indexDelete(u.key)
+	if u.existed {
+		db.index.set(u.key, u.pos)
+		if !u.pos.deleted {
+			db.addLiveBytes(u.pos, u.pos.size)
+			db.keyCount++
+		}
+		return
+	}
+	// Under the disk index the key may be back to a record in a sealed
+	// segment.
+	db.index.delete(u.key)
+	if pos, ok, _ := db.lookup(u.key); ok {
+		db.addLiveBytes(pos, pos.size)
+		db.keyCount++
+	}
+}
+
+func (db *Db) addLiveBytes(pos SegmentPos, delta int64) {
+	if seg := db.findSegment(pos.segmentNum); seg != nil {
+		seg.liveBytes += delta
+	}
+}
+
+// sealedGarbage returns the number of garbage bytes and the total number of
+// bytes in sealed segments. Must be called with db.mu held.
+func (db *Db) sealedGarbage() (garbage, total int64) {
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		garbage += seg.offset - seg.liveBytes
+		total += seg.offset
+	}
+	return garbage, total
+}
+
+// needsCompaction tells whether the policy calls for a compaction. Must be
+// called with db.mu held.
+func (db *Db) needsCompaction() bool {
+	p := db.opts.Compaction
+	sealed := len(db.segments) - 1
+	if sealed == 0 {
+		return false
+	}
+	if p.MaxSegments > 0 && sealed > p.MaxSegments {
+		return true
+	}
+	if p.GarbageRatio > 0 {
+		garbage, total := db.sealedGarbage()
+		return garbage > 0 && float64(garbage) >= p.GarbageRatio*float64(total)
+	}
+	return false
+}
+
+// maybeCompact starts a compaction if the policy calls for one and the last
+// one started long enough ago.
+func (db *Db) maybeCompact() {
+	p := db.opts.Compaction
+	if p.GarbageRatio == 0 && p.MaxSegments == 0 {
+		return
+	}
+
+	db.compactionMu.Lock()
+	wait := db.isCompacting || time.Since(db.lastCompaction) < p.MinInterval
+	db.compactionMu.Unlock()
+	if wait {
+		return
+	}
+
+	db.mu.Lock()
+	needed := db.needsCompaction()
+	db.mu.Unlock()
+	if needed {
+		db.Compact()
+	}
+}
@@ -0,0 +1,64 @@
+package datastore
+
+// WriteBatch collects puts and deletes that Db.Write commits atomically:
+// after a crash either all of them are visible or none is.
+type WriteBatch struct {
+	ops []entry
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.ops = append(b.ops, entry{key: key, value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, entry{key: key, deleted: true})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Write commits the batch. Operations are applied in the order they were
+// added. Unlike Db.Delete, deleting a key that does not exist is not an error
+// inside a batch; such deletes are skipped.
+func (db *Db) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	req := putRequest{
+		batch:  append([]entry(nil), b.ops...),
+		respCh: make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	return <-req.respCh
+}
+
+// batchRecords turns batch operations into the records to append, dropping
+// deletes of keys that are absent at that point of the batch. All records but
+// the last are marked as continued. Must be called with db.mu held.
+func (db *Db) batchRecords(ops []entry) ([]entry, error) {
+	var records []entry
+	present := make(map[string]bool)
+	for _, op := range ops {
+		if op.deleted {
+			exists, seen := present[op.key]
+			if !seen {
+				var err error
+				if exists, err = db.exists(op.key); err != nil {
+					return nil, err
+				}
+			}
+			if !exists {
+				continue
+			}
+		}
+		present[op.key] = !op.deleted
+		records = append(records, op)
+	}
+	for i := 0; i < len(records)-1; i++ {
+		records[i].continued = true
+	}
+	return records, nil
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// WithCache keeps up to maxBytes of recently read keys and values in memory,
+// evicting the least recently used ones first. Zero disables the cache.
+func WithCache(maxBytes int64) Option {
+	return func(o *Options) {
+		o.CacheSize = maxBytes
+	}
+}
+
+func (o *Options) validateCache() error {
+	if o.CacheSize < 0 {
+		return fmt.Errorf("cache size must not be negative, got %d", o.CacheSize)
+	}
+	return nil
+}
+
+// CacheStats describes the value cache. All fields stay zero when the cache
+// is disabled.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+// CacheStats returns the hit and miss counts of the value cache since Open
+// and what it currently holds.
+func (db *Db) CacheStats() CacheStats {
+	return db.cache.stats()
+}
+
+// valueCache is a size-bounded LRU cache of decoded values. An entry
+// remembers the record it was read from and only answers lookups for that
+// record, so a value that has since been overwritten or moved by compaction
+// is never returned, even if it was cached by a read racing with the change.
+// A nil cache caches nothing.
+type valueCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	items    map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cachedValue struct {
+	key        string
+	segmentNum int
+	offset     int64
+	value      string
+}
+
+func (v *cachedValue) cost() int64 {
+	return int64(len(v.key) + len(v.value))
+}
+
+func newValueCache(maxBytes int64) *valueCache {
+	if maxBytes == 0 {
+		return nil
+	}
+	return &valueCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *valueCache) get(key string, pos SegmentPos) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		v := el.Value.(*cachedValue)
+		if v.segmentNum == pos.segmentNum && v.offset == pos.offset {
+			c.lru.MoveToFront(el)
+			c.hits.Add(1)
+			return v.value, true
+		}
+	}
+	c.misses.Add(1)
+	return "", false
+}
+
+// add caches the value read from pos, replacing whatever was cached for the
+// key. Values that do not fit in the cache at all are left out.
+func (c *valueCache) add(key string, pos SegmentPos, value string) {
+	if c == nil {
+		return
+	}
+	v := &cachedValue{key: key, segmentNum: pos.segmentNum, offset: pos.offset, value: value}
+	if v.cost() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	c.items[key] = c.lru.PushFront(v)
+	c.bytes += v.cost()
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*cachedValue).key)
+	}
+}
+
+// remove drops the key, which is about to point at a different record.
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *valueCache) removeLocked(key string) {
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.items, key)
+	c.bytes -= el.Value.(*cachedValue).cost()
+}
+
+func (c *valueCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: len(c.items),
+		Bytes:   c.bytes,
+	}
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint writes a consistent copy of the database to targetDir, which is
+// created if needed and must be empty. The copy can be opened like any other
+// database, with the same encryption keys.
+//
+// Sealed segments never change, so they are hard-linked together with their
+// hint and key files, and copied only when the target is on another file
+// system. Writes are held off just while the links are made; the active
+// segment is copied afterwards, up to the offset it had at that moment.
+func (db *Db) Checkpoint(targetDir string) error {
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(targetDir)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("checkpoint directory %s is not empty", targetDir)
+	}
+
+	var created []string
+	cleanup := func() {
+		for _, path := range created {
+			os.Remove(path)
+		}
+	}
+
+	db.mu.Lock()
+	segments := append([]*Segment(nil), db.segments...)
+	for _, seg := range segments {
+		seg.acquire()
+	}
+	active := segments[len(segments)-1]
+	activeSize := active.offset
+
+	// Compaction removes sealed segments with db.mu held, so they cannot
+	// disappear while they are linked.
+	var toCopy []*Segment
+	for _, seg := range segments[:len(segments)-1] {
+		path := filepath.Join(targetDir, segmentName(seg.num))
+		if err := os.Link(seg.file.Name(), path); err != nil {
+			toCopy = append(toCopy, seg)
+			continue
+		}
+		created = append(created, path)
+		// Hint and key files only speed up Open, which rebuilds them if
+		// they are missing.
+		for _, aux := range []string{hintPath(seg.file.Name()), keysPath(seg.file.Name())} {
+			auxTarget := filepath.Join(targetDir, filepath.Base(aux))
+			if err := os.Link(aux, auxTarget); err == nil {
+				created = append(created, auxTarget)
+			}
+		}
+	}
+	db.mu.Unlock()
+
+	defer func() {
+		for _, seg := range segments {
+			if err := seg.release(); err != nil {
+				db.logf("Error releasing checkpointed segment: %v", err)
+			}
+		}
+	}()
+
+	for _, seg := range toCopy {
+		path := filepath.Join(targetDir, segmentName(seg.num))
+		created = append(created, path)
+		if err := copySegment(seg, seg.offset, path); err != nil {
+			cleanup()
+			return fmt.Errorf("failed to copy segment %d: %w", seg.num, err)
+		}
+	}
+	activePath := filepath.Join(targetDir, segmentName(active.num))
+	created = append(created, activePath)
+	if err := copySegment(active, activeSize, activePath); err != nil {
+		cleanup()
+		return fmt.Errorf("failed to copy active segment %d: %w", active.num, err)
+	}
+
+	nums := make([]int, len(segments))
+	for i, seg := range segments {
+		nums[i] = seg.num
+	}
+	created = append(created, filepath.Join(targetDir, manifestName))
+	if err := writeManifest(targetDir, nums); err != nil {
+		cleanup()
+		return fmt.Errorf("failed to write checkpoint manifest: %w", err)
+	}
+	return nil
+}
+
+// copySegment copies the first size bytes of the segment to path through the
+// segment's own handle, which stays valid even if compaction has removed the
+// file since. The copy is synced before it is closed.
+func copySegment(seg *Segment, size int64, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.NewSectionReader(seg.file, 0, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WithCompression deflates values of at least threshold bytes before they are
+// written. A threshold of 0 turns compression off. Compressed records stay
+// readable whatever the option is set to when the database is opened again.
+func WithCompression(threshold int) Option {
+	return func(o *Options) {
+		o.CompressThreshold = threshold
+	}
+}
+
+func (o *Options) validateCompression() error {
+	if o.CompressThreshold < 0 {
+		return fmt.Errorf("compression threshold must not be negative, got %d", o.CompressThreshold)
+	}
+	return nil
+}
+
+// compressValue deflates the value of the record if it is large enough and
+// compression actually makes it smaller.
+func (db *Db) compressValue(e *entry) {
+	if db.opts.CompressThreshold == 0 || e.deleted || e.isInt64 || e.compressed || len(e.value) < db.opts.CompressThreshold {
+		return
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	if _, err := io.WriteString(w, e.value); err != nil {
+		return
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(e.value) {
+		return
+	}
+	e.value = buf.String()
+	e.compressed = true
+}
+
+// decompress restores the original value of a compressed record.
+func (e *entry) decompress() error {
+	if !e.compressed {
+		return nil
+	}
+	value, err := io.ReadAll(flate.NewReader(strings.NewReader(e.value)))
+	if err != nil {
+		return fmt.Errorf("%w: cannot decompress value: %v", ErrCorrupted, err)
+	}
+	e.value = string(value)
+	e.compressed = false
+	return nil
+}
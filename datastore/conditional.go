@@ -0,0 +1,175 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrConflict is returned by conditional writes whose condition does not hold
+// when the write is committed.
+var ErrConflict = errors.New("write condition failed")
+
+type conditionKind int
+
+const (
+	condNone conditionKind = iota
+	// condValue requires the key to be present with the given value.
+	condValue
+	// condVersion requires the key to be at the given version, where version 0
+	// means the key must be absent.
+	condVersion
+	// condExists requires the key to be present.
+	condExists
+)
+
+// condition is checked by the writer goroutine right before the records of a
+// request are staged, so nothing can change the key in between.
+type condition struct {
+	kind    conditionKind
+	value   string
+	version uint64
+}
+
+// CompareAndSwap stores value only if the key currently holds expected. It
+// returns ErrConflict if the key holds something else or does not exist.
+func (db *Db) CompareAndSwap(key, expected, value string) error {
+	req := putRequest{
+		key:    key,
+		value:  value,
+		cond:   condition{kind: condValue, value: expected},
+		respCh: make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	return <-req.respCh
+}
+
+// PutIfVersion stores value only if the key is at the given version, as
+// reported by GetVersioned. Version 0 stores the value only if the key does not
+// exist. It returns ErrConflict otherwise.
+func (db *Db) PutIfVersion(key, value string, version uint64) error {
+	req := putRequest{
+		key:    key,
+		value:  value,
+		cond:   condition{kind: condVersion, version: version},
+		respCh: make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	return <-req.respCh
+}
+
+// PutIfExists stores value only if the key exists, whatever its version. It
+// returns ErrConflict otherwise.
+func (db *Db) PutIfExists(key, value string) error {
+	req := putRequest{
+		key:    key,
+		value:  value,
+		cond:   condition{kind: condExists},
+		respCh: make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	return <-req.respCh
+}
+
+// GetVersioned returns the value together with its version. The version grows
+// by one with every write of the key and starts over at 1 once the key has been
+// deleted or has expired.
+func (db *Db) GetVersioned(key string) (string, uint64, error) {
+	db.ops.gets.Add(1)
+	db.mu.Lock()
+	pos, ok := db.index.get(key)
+	if !ok && db.opts.DiskIndex {
+		// The key can only be in a key file, which is searched without
+		// db.mu held so that other reads and writes go on meanwhile.
+		snap := db.snapshotLocked()
+		db.mu.Unlock()
+		defer snap.Release()
+		return snap.getVersioned(key)
+	}
+	if !ok || pos.deleted || pos.expired(time.Now().UnixNano()) {
+		db.mu.Unlock()
+		return "", 0, ErrNotFound
+	}
+	seg := db.findSegment(pos.segmentNum)
+	if seg == nil {
+		db.mu.Unlock()
+		return "", 0, fmt.Errorf("segment %d for key %s not found in active segments during lookup", pos.segmentNum, key)
+	}
+	seg.acquire()
+	db.mu.Unlock()
+	defer seg.release()
+
+	value, err := db.readValue(key, pos, seg)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, pos.version, nil
+}
+
+// currentVersion returns the version of the key, or 0 if it is absent. Must be
+// called with db.mu held.
+func (db *Db) currentVersion(key string) (uint64, error) {
+	pos, ok, err := db.lookup(key)
+	if err != nil || !ok || pos.expired(time.Now().UnixNano()) {
+		return 0, err
+	}
+	return pos.version, nil
+}
+
+// checkCondition evaluates the condition of a request against the committed
+// state of the key. Value conditions read the current record, so the caller
+// must flush staged records first. Must be called with db.mu held.
+func (db *Db) checkCondition(key string, cond condition) error {
+	switch cond.kind {
+	case condVersion:
+		version, err := db.currentVersion(key)
+		if err != nil {
+			return err
+		}
+		if version != cond.version {
+			return ErrConflict
+		}
+	case condExists:
+		version, err := db.currentVersion(key)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			return ErrConflict
+		}
+	case condValue:
+		record, ok, err := db.currentRecord(key)
+		if err != nil {
+			return err
+		}
+		if !ok || record.stringValue() != cond.value {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// currentRecord reads the latest record of the key from its segment. It
+// reports false if the key is absent. The record must not be staged, so
+// callers flush first. Must be called with db.mu held.
+func (db *Db) currentRecord(key string) (entry, bool, error) {
+	pos, ok, err := db.lookup(key)
+	if err != nil || !ok || pos.expired(time.Now().UnixNano()) {
+		return entry{}, false, err
+	}
+	seg := db.findSegment(pos.segmentNum)
+	if seg == nil {
+		return entry{}, false, fmt.Errorf("segment %d for key %s not found in active segments while reading current value", pos.segmentNum, key)
+	}
+	record, err := readEntry(key, pos, seg.file, db.keys)
+	if err != nil {
+		return entry{}, false, err
+	}
+	return record, true, nil
+}
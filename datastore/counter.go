@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	ErrNotInt64 = errors.New("value is not an int64")
+	ErrOverflow = errors.New("int64 overflow")
+)
+
+// increment asks the writer goroutine to add delta to the stored value and
+// report the sum back in result.
+type increment struct {
+	delta, result int64
+}
+
+// PutInt64 stores value in binary form. Get returns it formatted in decimal.
+func (db *Db) PutInt64(key string, value int64) error {
+	record := int64Entry(key, value)
+	req := putRequest{
+		key:     key,
+		value:   record.value,
+		isInt64: true,
+		respCh:  make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	return <-req.respCh
+}
+
+// GetInt64 returns the value of a key written by PutInt64 or Increment, or of
+// any value holding a decimal int64. Other values fail with ErrNotInt64.
+func (db *Db) GetInt64(key string) (int64, error) {
+	value, err := db.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: key %s holds %q", ErrNotInt64, key, value)
+	}
+	return n, nil
+}
+
+// Increment atomically adds delta to the value of the key and returns the new
+// value. A missing key counts as 0. The key keeps its expiry time, if any.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	incr := &increment{delta: delta}
+	req := putRequest{
+		key:    key,
+		incr:   incr,
+		respCh: make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	if err := <-req.respCh; err != nil {
+		return 0, err
+	}
+	return incr.result, nil
+}
+
+// incrementRecords returns the record holding the incremented value. Must be
+// called with db.mu held and nothing staged for the key.
+func (db *Db) incrementRecords(key string, incr *increment) ([]entry, error) {
+	current, ok, err := db.currentRecord(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var n int64
+	if ok {
+		if n, err = current.asInt64(); err != nil {
+			return nil, fmt.Errorf("cannot increment key %s: %w", key, err)
+		}
+	}
+	sum := n + incr.delta
+	if (incr.delta > 0 && sum < n) || (incr.delta < 0 && sum > n) {
+		return nil, fmt.Errorf("%w: incrementing key %s holding %d by %d", ErrOverflow, key, n, incr.delta)
+	}
+
+	record := int64Entry(key, sum)
+	record.expiresAt = current.expiresAt
+	incr.result = sum
+	return []entry{record}, nil
+}
+
+func (e *entry) asInt64() (int64, error) {
+	if e.isInt64 {
+		return e.int64Value(), nil
+	}
+	n, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrNotInt64, e.value)
+	}
+	return n, nil
+}
@@ -2,16 +2,16 @@ package datastore
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
-	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -20,31 +20,86 @@ const (
 )
 
 var (
-	ErrNotFound = errors.New("record does not exist")
+	ErrNotFound  = errors.New("record does not exist")
+	ErrCorrupted = errors.New("record is corrupted")
+	// ErrUnsupportedFormat is returned by Open for a directory written in a
+	// format this version cannot read.
+	ErrUnsupportedFormat = errors.New("unsupported data format")
 )
 
 type Segment struct {
 	num    int
 	file   *os.File
 	offset int64
+
+	// refs counts the users of the segment: the database while the segment
+	// is in db.segments, plus reads and snapshots still using it. The file is
+	// closed when the last user releases it.
+	refs atomic.Int32
+
+	// hints collects the records appended to the active segment so that
+	// the hint file can be written when the segment is sealed.
+	hints []hintEntry
+
+	// liveBytes is the size of the records the index points to. The rest of
+	// the segment is garbage that compaction would drop. Guarded by db.mu.
+	liveBytes int64
+
+	// keys is the key file of a sealed segment under the disk index. It is
+	// set when the segment is sealed, with db.mu held.
+	keys *keyFile
 }
 
 type SegmentPos struct {
 	segmentNum int
 	offset     int64
+	expiresAt  int64
+	version    uint64
+	// size is the encoded size of the record.
+	size int64
+	// deleted marks a tombstone. Only the disk index keeps those.
+	deleted bool
+}
+
+func (pos SegmentPos) expired(now int64) bool {
+	return expired(pos.expiresAt, now)
 }
 
 type putRequest struct {
-	key    string
-	value  string
-	respCh chan error
+	key       string
+	value     string
+	deleted   bool
+	isInt64   bool
+	expiresAt int64
+	cond      condition
+	incr      *increment
+	batch     []entry
+	respCh    chan error
+}
+
+// keys returns the keys the request writes.
+func (req putRequest) keys() []string {
+	if req.batch == nil {
+		return []string{req.key}
+	}
+	keys := make([]string, len(req.batch))
+	for i, op := range req.batch {
+		keys[i] = op.key
+	}
+	return keys
+}
+
+// readsCurrentValue reports whether committing the request needs the current
+// value of the key, which has to be flushed to the segment to be read.
+func (req putRequest) readsCurrentValue() bool {
+	return req.cond.kind == condValue || req.incr != nil
 }
 
 type getRequest struct {
-	key      string
-	offset   int64
-	filePath string
-	respCh   chan getResponse
+	key    string
+	pos    SegmentPos
+	seg    *Segment
+	respCh chan getResponse
 }
 
 type getResponse struct {
@@ -55,73 +110,139 @@ type getResponse struct {
 type Db struct {
 	mu             sync.Mutex
 	dir            string
+	opts           Options
 	segments       []*Segment
-	index          map[string]SegmentPos
-	maxSegmentSize int64
-
-	compactionWg sync.WaitGroup
-	compactionMu sync.Mutex
-	isCompacting bool
+	nextSegmentNum int
+	index          keyIndex
+
+	compactionWg   sync.WaitGroup
+	compactionMu   sync.Mutex
+	isCompacting   bool
+	lastCompaction time.Time
+	// lastCompactionDuration and lastCompactionErr describe the last
+	// compaction that finished. Guarded by compactionMu.
+	lastCompactionDuration time.Duration
+	lastCompactionErr      error
 
 	putRequests chan putRequest
 	writerWg    sync.WaitGroup
 
-	getRequests   chan getRequest
-	getWorkersWg  sync.WaitGroup
-	numGetWorkers int
+	getRequests    chan getRequest
+	getWorkersWg   sync.WaitGroup
+	busyGetWorkers atomic.Int32
+
+	ops opCounters
+
+	cache *valueCache
+	keys  *keyring
+
+	// segmentsGen is bumped whenever db.segments changes after Open, which
+	// is when key files come and go. Guarded by db.mu.
+	segmentsGen uint64
+	// prefetched is set by the writer while it commits a group under the
+	// disk index. Guarded by db.mu.
+	prefetched *sealedLookups
+	// manifestMu serializes changes to the segment list, so that the
+	// manifest can be written without holding db.mu. It is taken before
+	// db.mu; the writer holds it while committing a group, which may roll
+	// over the active segment.
+	manifestMu sync.Mutex
+	// keyCount is the number of keys that have not been deleted, which
+	// under the disk index the in-memory index alone does not tell. Guarded
+	// by db.mu.
+	keyCount int
+	// compactionWrites collects the keys written since the running
+	// compaction froze the index, and is nil when none runs. Guarded by
+	// db.mu.
+	compactionWrites map[string]struct{}
+
+	dirty    bool
+	syncStop chan struct{}
+	syncWg   sync.WaitGroup
 }
 
-func Open(dir string, maxSegmentSize int64) (*Db, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, err
+// Open opens the database in dir, creating it if needed, with the given
+// maximum segment size and options.
+func Open(dir string, maxSegmentSize int64, opts ...Option) (*Db, error) {
+	o := Options{MaxSegmentSize: maxSegmentSize}
+	for _, opt := range opts {
+		opt(&o)
 	}
+	return OpenWithOptions(dir, o)
+}
 
-	files, err := os.ReadDir(dir)
-	if err != nil {
+// OpenWithOptions opens the database in dir. Unless opts.ReadOnly is set,
+// the directory is created if needed.
+func OpenWithOptions(dir string, opts Options) (*Db, error) {
+	if err := opts.Validate(); err != nil {
 		return nil, err
 	}
-
-	var segmentFiles []string
-	for _, f := range files {
-		name := f.Name()
-		if strings.HasPrefix(name, segmentPrefix) && !strings.HasSuffix(name, mergeSuffix) {
-			segmentFiles = append(segmentFiles, name)
+	if !opts.ReadOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
 		}
 	}
 
-	sort.Slice(segmentFiles, func(i, j int) bool {
-		return extractNum(segmentFiles[i]) < extractNum(segmentFiles[j])
-	})
+	segmentNums, legacy, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ReadOnly && len(segmentNums) == 0 {
+		return nil, fmt.Errorf("cannot open %s read-only: no database there", dir)
+	}
+	if opts.ReadOnly && legacy {
+		return nil, fmt.Errorf("%w: %s is in the original format and has to be opened for writing once to convert it", ErrUnsupportedFormat, dir)
+	}
 
 	db := &Db{
 		dir:            dir,
+		opts:           opts.withDefaults(),
 		segments:       make([]*Segment, 0),
-		index:          make(map[string]SegmentPos),
-		maxSegmentSize: maxSegmentSize,
-		putRequests:    make(chan putRequest, 100),
-		numGetWorkers:  runtime.NumCPU() * 2,
+		nextSegmentNum: 1,
 		getRequests:    make(chan getRequest),
+		syncStop:       make(chan struct{}),
+	}
+	db.putRequests = make(chan putRequest, db.opts.QueueDepth)
+	db.cache = newValueCache(db.opts.CacheSize)
+	if db.keys, err = newKeyring(db.opts.EncryptionKeys); err != nil {
+		return nil, err
+	}
+	if legacy {
+		if segmentNums, err = db.convertLegacy(segmentNums); err != nil {
+			return nil, fmt.Errorf("failed to convert %s from the original format: %w", dir, err)
+		}
+	}
+	if !opts.ReadOnly {
+		if err := db.removeOrphans(segmentNums); err != nil {
+			return nil, err
+		}
 	}
 
-	for _, segFile := range segmentFiles {
-		seg, err := openSegment(dir, segFile)
+	for _, num := range segmentNums {
+		seg, err := db.openSegment(num)
 		if err != nil {
 			db.Close()
 			return nil, err
 		}
 		db.segments = append(db.segments, seg)
+		db.nextSegmentNum = max(db.nextSegmentNum, num+1)
 	}
 
 	if len(db.segments) == 0 {
-		seg, err := createNewSegment(dir, 1)
+		seg, err := createNewSegment(dir, db.nextSegmentNum)
 		if err != nil {
 			return nil, err
 		}
 		db.segments = append(db.segments, seg)
+		db.nextSegmentNum++
+		if err := db.saveManifest(db.segments); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
-	for _, seg := range db.segments {
-		if err := db.recoverSegment(seg); err != nil {
+	for i, seg := range db.segments {
+		if err := db.loadSegment(seg, i == len(db.segments)-1); err != nil {
 			db.Close()
 			return nil, err
 		}
@@ -130,7 +251,12 @@ func Open(dir string, maxSegmentSize int64) (*Db, error) {
 	db.writerWg.Add(1)
 	go db.writerGoroutine()
 
-	for i := 0; i < db.numGetWorkers; i++ {
+	if db.opts.SyncPolicy == SyncInterval && !opts.ReadOnly {
+		db.syncWg.Add(1)
+		go db.syncLoop()
+	}
+
+	for i := 0; i < db.opts.GetWorkers; i++ {
 		db.getWorkersWg.Add(1)
 		go db.getWorker()
 	}
@@ -138,22 +264,14 @@ func Open(dir string, maxSegmentSize int64) (*Db, error) {
 	return db, nil
 }
 
-func extractNum(filename string) int {
-	parts := strings.SplitN(filename, "-", 2)
-	if len(parts) != 2 {
-		return 0
-	}
-	numStr := strings.TrimLeft(parts[1], "0")
-	if numStr == "" {
-		return 0
-	}
-	num, _ := strconv.Atoi(numStr)
-	return num
+// isSegmentFile tells segment data files apart from the merge, hint and
+// temporary files that share the segment prefix.
+func isSegmentFile(name string) bool {
+	return strings.HasPrefix(name, segmentPrefix) && filepath.Ext(name) == ""
 }
 
 func createNewSegment(dir string, num int) (*Segment, error) {
-	name := fmt.Sprintf("%s%04d", segmentPrefix, num)
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(num)), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -162,16 +280,15 @@ func createNewSegment(dir string, num int) (*Segment, error) {
 		f.Close()
 		return nil, err
 	}
-	return &Segment{
-		num:    num,
-		file:   f,
-		offset: stat.Size(),
-	}, nil
+	return newSegment(num, f, stat.Size()), nil
 }
 
-func openSegment(dir, name string) (*Segment, error) {
-	num := extractNum(name)
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_APPEND, 0644)
+func (db *Db) openSegment(num int) (*Segment, error) {
+	flag := os.O_RDWR | os.O_APPEND
+	if db.opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filepath.Join(db.dir, segmentName(num)), flag, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -180,14 +297,127 @@ func openSegment(dir, name string) (*Segment, error) {
 		f.Close()
 		return nil, err
 	}
-	return &Segment{
+	return newSegment(num, f, stat.Size()), nil
+}
+
+func newSegment(num int, f *os.File, size int64) *Segment {
+	seg := &Segment{
 		num:    num,
 		file:   f,
-		offset: stat.Size(),
-	}, nil
+		offset: size,
+	}
+	seg.refs.Store(1)
+	return seg
+}
+
+// discardSegment closes and removes a segment that never made it into the
+// manifest.
+func (db *Db) discardSegment(seg *Segment) {
+	path := seg.file.Name()
+	seg.release()
+	os.Remove(path)
+	os.Remove(hintPath(path))
+	os.Remove(keysPath(path))
+}
+
+func (seg *Segment) acquire() {
+	seg.refs.Add(1)
+}
+
+func (seg *Segment) release() error {
+	if seg.refs.Add(-1) != 0 {
+		return nil
+	}
+	if seg.keys != nil {
+		if err := seg.keys.close(); err != nil {
+			return fmt.Errorf("failed to close key file of segment %d: %w", seg.num, err)
+		}
+	}
+	if err := seg.file.Close(); err != nil {
+		return fmt.Errorf("failed to close segment file %s: %w", seg.file.Name(), err)
+	}
+	return nil
+}
+
+// loadSegment adds the segment's records to the index. Under the disk index
+// only the active segment is, while sealed ones just open their key files.
+func (db *Db) loadSegment(seg *Segment, isLast bool) error {
+	if isLast {
+		if db.opts.DiskIndex {
+			if err := db.countLiveBytes(); err != nil {
+				return err
+			}
+		}
+		if err := db.recoverSegment(seg, true); err != nil {
+			return err
+		}
+		db.applyHints(seg, seg.hints)
+		return nil
+	}
+	if db.opts.DiskIndex {
+		return db.loadKeyFile(seg)
+	}
+
+	hints, err := db.segmentHints(seg)
+	if err != nil {
+		return err
+	}
+	db.applyHints(seg, hints)
+	return nil
 }
 
-func (db *Db) recoverSegment(seg *Segment) error {
+// segmentHints returns the records of a sealed segment. They come from its
+// hint file when that matches the segment; otherwise the segment is scanned
+// in full and its hint file is rebuilt for the next start.
+func (db *Db) segmentHints(seg *Segment) ([]hintEntry, error) {
+	hints, err := readHintFile(seg.file.Name(), seg.offset, db.keys)
+	if err == nil {
+		return hints, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		db.logf("Ignoring hint file for segment %d: %v", seg.num, err)
+	}
+
+	if err := db.recoverSegment(seg, false); err != nil {
+		return nil, err
+	}
+	hints = seg.hints
+	db.sealSegment(seg)
+	return hints, nil
+}
+
+// applyHints updates the index with records of the segment. Expired records
+// are dropped right away, just like deleted ones.
+func (db *Db) applyHints(seg *Segment, hints []hintEntry) {
+	now := time.Now().UnixNano()
+	for _, h := range hints {
+		if h.deleted || expired(h.expiresAt, now) {
+			db.indexDelete(h.key)
+		} else {
+			db.indexSet(h.key, SegmentPos{segmentNum: seg.num, offset: h.offset, expiresAt: h.expiresAt, version: h.version, size: h.size})
+		}
+	}
+}
+
+// sealSegment writes the hint file for a segment that no longer receives
+// writes. Hints only speed up Open, so failing to write one is not fatal.
+func (db *Db) sealSegment(seg *Segment) {
+	if db.opts.ReadOnly {
+		seg.hints = nil
+		return
+	}
+	if err := writeHintFile(seg.file.Name(), seg.offset, seg.hints, db.keys); err != nil {
+		db.logf("Failed to write hint file for segment %d: %v", seg.num, err)
+	}
+	seg.hints = nil
+}
+
+// recoverSegment scans the segment and collects its records in seg.hints. Only
+// the last segment can hold a torn write left by a crash in the middle of a
+// write, so there an incomplete final record or write batch is cut off instead
+// of failing the whole recovery. Records of a batch are collected only once
+// its last record has been read.
+func (db *Db) recoverSegment(seg *Segment, isLast bool) error {
 	file, err := os.Open(seg.file.Name())
 	if err != nil {
 		return err
@@ -195,7 +425,9 @@ func (db *Db) recoverSegment(seg *Segment) error {
 	defer file.Close()
 
 	reader := bufio.NewReader(file)
-	var offset int64 = 0
+	var offset, batchStart int64
+	var batch []hintEntry
+	seg.hints = nil
 
 	for {
 		var record entry
@@ -204,46 +436,96 @@ func (db *Db) recoverSegment(seg *Segment) error {
 			break
 		}
 		if err != nil {
+			if isLast && isTornWrite(err) {
+				// A damaged size field also makes a record look cut short,
+				// but then acknowledged records follow it.
+				found, scanErr := hasRecordAfter(seg.file, offset, seg.offset)
+				if scanErr != nil {
+					return fmt.Errorf("error recovering segment %d at offset %d: %w", seg.num, offset, scanErr)
+				}
+				if found {
+					return fmt.Errorf("error recovering segment %d at offset %d: %w, and valid records follow it", seg.num, offset, err)
+				}
+				return db.truncateSegment(seg, batchStart, err)
+			}
+			return fmt.Errorf("error recovering segment %d at offset %d: %w", seg.num, offset, err)
+		}
+		if err := db.keys.decrypt(&record); err != nil {
 			return fmt.Errorf("error recovering segment %d at offset %d: %w", seg.num, offset, err)
 		}
 
-		db.index[record.key] = SegmentPos{seg.num, offset}
+		batch = append(batch, hintEntry{key: record.key, offset: offset, size: int64(n), deleted: record.deleted, expiresAt: record.expiresAt, version: record.version})
 		offset += int64(n)
+		if record.continued {
+			continue
+		}
+		seg.hints = append(seg.hints, batch...)
+		batch = batch[:0]
+		batchStart = offset
+	}
+
+	if len(batch) > 0 {
+		if isLast {
+			return db.truncateSegment(seg, batchStart, fmt.Errorf("write batch is incomplete: %w", io.ErrUnexpectedEOF))
+		}
+		return fmt.Errorf("error recovering segment %d: %w: write batch at offset %d is incomplete", seg.num, ErrCorrupted, batchStart)
 	}
 	return nil
 }
 
-func (db *Db) writerGoroutine() {
-	defer db.writerWg.Done()
-	for req := range db.putRequests {
-		db.mu.Lock()
-		err := db.performPut(req.key, req.value)
-		db.mu.Unlock()
-		req.respCh <- err
-	}
+// isTornWrite reports whether a decoding error is what an interrupted append
+// leaves behind: a record cut short by the end of the file. A complete record
+// that fails its checksum may have been acknowledged and damaged later, so it
+// is never taken for one.
+func isTornWrite(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF)
 }
 
-func (db *Db) performPut(key, value string) error {
-	activeSeg := db.getActiveSegment()
-	if activeSeg.offset >= db.maxSegmentSize {
-		newSeg, err := createNewSegment(db.dir, activeSeg.num+1)
-		if err != nil {
-			return err
+// hasRecordAfter reports whether a valid record starts anywhere in the file
+// after the damaged record at offset, up to size. Lengths are checked before
+// the checksum, so stray bytes rarely cost a checksum computation.
+func hasRecordAfter(file *os.File, offset, size int64) (bool, error) {
+	if size-offset-1 < headerSize {
+		return false, nil
+	}
+	tail := make([]byte, size-offset-1)
+	if _, err := file.ReadAt(tail, offset+1); err != nil {
+		return false, err
+	}
+	for i := 0; i+headerSize <= len(tail); i++ {
+		rest := tail[i:]
+		recordSize := int(binary.LittleEndian.Uint32(rest))
+		if recordSize < headerSize || recordSize > len(rest) {
+			continue
+		}
+		record := rest[:recordSize]
+		kl := int(binary.LittleEndian.Uint32(record[25:]))
+		if kl > recordSize-headerSize {
+			continue
+		}
+		vl := int(binary.LittleEndian.Uint32(record[keyOffset+kl:]))
+		if kl+vl+headerSize != recordSize {
+			continue
+		}
+		if _, _, err := peekRecord(record); err == nil {
+			return true, nil
 		}
-		db.segments = append(db.segments, newSeg)
-		activeSeg = newSeg
 	}
+	return false, nil
+}
 
-	e := entry{key: key, value: value}
-	data := e.Encode()
-
-	n, err := activeSeg.file.Write(data)
-	if err != nil {
-		return err
+func (db *Db) truncateSegment(seg *Segment, offset int64, cause error) error {
+	discarded := seg.offset - offset
+	if db.opts.ReadOnly {
+		seg.offset = offset
+		db.logf("Skipping %d bytes of incomplete record at offset %d in segment %d: %v", discarded, offset, seg.num, cause)
+		return nil
 	}
-
-	db.index[key] = SegmentPos{activeSeg.num, activeSeg.offset}
-	activeSeg.offset += int64(n)
+	if err := seg.file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate torn write in segment %d at offset %d: %w", seg.num, offset, err)
+	}
+	seg.offset = offset
+	db.logf("Discarded %d bytes of incomplete record at offset %d in segment %d: %v", discarded, offset, seg.num, cause)
 	return nil
 }
 
@@ -259,65 +541,114 @@ func (db *Db) Put(key, value string) error {
 	return <-req.respCh
 }
 
+// PutWithTTL stores the value so that it disappears once ttl has passed. The
+// expiry time is persisted with the record and survives restarts.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	req := putRequest{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(ttl).UnixNano(),
+		respCh:    make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	return <-req.respCh
+}
+
+// Delete removes the key by appending a tombstone record. The tombstone keeps
+// the key hidden after a restart until compaction drops both of them.
+func (db *Db) Delete(key string) error {
+	req := putRequest{
+		key:     key,
+		deleted: true,
+		respCh:  make(chan error, 1),
+	}
+
+	db.putRequests <- req
+
+	return <-req.respCh
+}
+
 func (db *Db) getWorker() {
 	defer db.getWorkersWg.Done()
 	for req := range db.getRequests {
-		value, err := db.readRecordFromFile(req.key, req.offset, req.filePath)
+		db.busyGetWorkers.Add(1)
+		value, err := readRecordFromFile(req.key, req.pos, req.seg.file, db.keys)
+		db.busyGetWorkers.Add(-1)
 		req.respCh <- getResponse{value: value, err: err}
 	}
 }
 
-func (db *Db) readRecordFromFile(key string, offset int64, filePath string) (string, error) {
-	file, err := os.Open(filePath)
+// readRecordFromFile reads through the segment's own handle rather than by
+// path, because compaction may have replaced the file under that name.
+func readRecordFromFile(key string, pos SegmentPos, file *os.File, ring *keyring) (string, error) {
+	record, err := readEntry(key, pos, file, ring)
 	if err != nil {
-		return "", fmt.Errorf("failed to open segment file %s for key %s: %w", filePath, key, err)
+		return "", err
 	}
-	defer file.Close()
+	return record.stringValue(), nil
+}
 
-	_, err = file.Seek(offset, io.SeekStart)
-	if err != nil {
-		return "", fmt.Errorf("failed to seek to offset %d in segment %s for key %s: %w", offset, filePath, key, err)
+// readEntry fetches the record with a single positional read of its known
+// size. ReadAt neither moves nor depends on the file offset, so all readers
+// share the segment's handle with the writer appending to it.
+func readEntry(key string, pos SegmentPos, file *os.File, ring *keyring) (entry, error) {
+	filePath := file.Name()
+	offset := pos.offset
+	buf := make([]byte, pos.size)
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return entry{}, fmt.Errorf("failed to read record at offset %d in segment %s for key %s: %w", offset, filePath, key, err)
 	}
 
 	var record entry
-	_, err = record.DecodeFromReader(bufio.NewReader(file))
-	if err != nil {
-		return "", fmt.Errorf("failed to decode record at offset %d in segment %s for key %s: %w", offset, filePath, key, err)
+	if err := record.Decode(buf); err != nil {
+		return entry{}, fmt.Errorf("failed to decode record at offset %d in segment %s for key %s: %w", offset, filePath, key, err)
+	}
+	if err := ring.decrypt(&record); err != nil {
+		return entry{}, fmt.Errorf("failed to decrypt record at offset %d in segment %s for key %s: %w", offset, filePath, key, err)
 	}
 
 	if record.key != key {
-		return "", fmt.Errorf("key mismatch: expected %s, got %s at offset %d in segment %s", key, record.key, offset, filePath)
+		return entry{}, fmt.Errorf("key mismatch: expected %s, got %s at offset %d in segment %s", key, record.key, offset, filePath)
+	}
+	if err := record.decompress(); err != nil {
+		return entry{}, fmt.Errorf("failed to read record at offset %d in segment %s for key %s: %w", offset, filePath, key, err)
 	}
 
-	return record.value, nil
+	return record, nil
 }
 
 func (db *Db) Get(key string) (string, error) {
-	db.mu.Lock()
-	pos, ok := db.index[key]
-	if !ok {
-		db.mu.Unlock()
-		return "", ErrNotFound
-	}
+	value, _, err := db.GetVersioned(key)
+	return value, err
+}
 
-	seg := db.findSegment(pos.segmentNum)
-	if seg == nil {
-		db.mu.Unlock()
-		return "", fmt.Errorf("segment %d for key %s not found in active segments during lookup", pos.segmentNum, key)
+// readValue reads a record from the cache or through the get workers. The
+// caller must hold a reference to seg.
+func (db *Db) readValue(key string, pos SegmentPos, seg *Segment) (string, error) {
+	if value, ok := db.cache.get(key, pos); ok {
+		return value, nil
 	}
-	filePath := seg.file.Name()
-	db.mu.Unlock()
-
 	req := getRequest{
-		key:      key,
-		offset:   pos.offset,
-		filePath: filePath,
-		respCh:   make(chan getResponse, 1),
+		key:    key,
+		pos:    pos,
+		seg:    seg,
+		respCh: make(chan getResponse, 1),
 	}
 
 	db.getRequests <- req
 
 	resp := <-req.respCh
+	if resp.err == nil {
+		db.cache.add(key, pos, resp.value)
+	}
 	return resp.value, resp.err
 }
 
@@ -335,181 +666,356 @@ func (db *Db) findSegment(num int) *Segment {
 }
 
 func (db *Db) Compact() {
+	if db.opts.ReadOnly {
+		db.logf("Compaction is not available in read-only mode.")
+		return
+	}
 	db.compactionMu.Lock()
 	if db.isCompacting {
 		db.compactionMu.Unlock()
-		fmt.Println("Compaction already in progress, skipping new request.")
+		db.logf("Compaction already in progress, skipping new request.")
 		return
 	}
 	db.isCompacting = true
+	db.lastCompaction = time.Now()
 	db.compactionMu.Unlock()
 
 	db.compactionWg.Add(1)
 	go func() {
 		defer db.compactionWg.Done()
-		defer func() {
-			db.compactionMu.Lock()
-			db.isCompacting = false
-			db.compactionMu.Unlock()
-		}()
-
-		fmt.Println("Starting background compaction...")
-		if err := db.performCompaction(); err != nil {
-			fmt.Fprintf(os.Stderr, "Background compaction failed: %v\n", err)
+
+		db.logf("Starting background compaction...")
+		err := db.performCompaction()
+
+		db.compactionMu.Lock()
+		db.isCompacting = false
+		db.lastCompactionDuration = time.Since(db.lastCompaction)
+		db.lastCompactionErr = err
+		db.compactionMu.Unlock()
+
+		if err != nil {
+			db.logf("Background compaction failed: %v", err)
 		} else {
-			fmt.Println("Background compaction completed successfully.")
+			db.logf("Background compaction completed successfully.")
 		}
 	}()
 }
 
+// performCompaction merges the sealed segments into one. Files are read and
+// written without holding db.mu; the lock is only taken to pick the segments
+// and, at the end, to swap the merged segment in. Writes made meanwhile go to
+// the active segment or newer ones, which are left alone. Their keys are
+// collected in db.compactionWrites, and the swap only has to look at those:
+// the index pointing at the merged segment is built beforehand from the
+// frozen copy the records were picked from.
+//
+// Only the records a frozen copy of the index points to are copied, one at a
+// time, so memory grows with the number of keys rather than with their values.
+// Under the disk index not even the keys are collected: the merged segment's
+// key file is written as the records are copied, and nothing in memory points
+// at the compacted segments.
+//
+// The merged segment gets a new number; it is the manifest, updated in a
+// single atomic step, that puts it in place of the compacted segments. A
+// crash before that leaves the merged file an orphan for Open to remove.
 func (db *Db) performCompaction() error {
 	db.mu.Lock()
-	defer db.mu.Unlock()
-
 	if len(db.segments) < 2 {
+		db.mu.Unlock()
 		return nil
 	}
+	segmentsToCompact := append([]*Segment(nil), db.segments[:len(db.segments)-1]...)
+	table := db.keyTable()
+	mergedNum := db.nextSegmentNum
+	db.nextSegmentNum++
+	db.compactionWrites = make(map[string]struct{})
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.compactionWrites = nil
+		db.mu.Unlock()
+	}()
 
-	mergeNum := db.segments[len(db.segments)-1].num + 1
-	mergeName := fmt.Sprintf("%s%04d%s", segmentPrefix, mergeNum, mergeSuffix)
-	mergePath := filepath.Join(db.dir, mergeName)
+	mergedPath := filepath.Join(db.dir, segmentName(mergedNum))
+	mergePath := mergedPath + mergeSuffix
 
 	mergeFile, err := os.Create(mergePath)
 	if err != nil {
 		return err
 	}
 
-	mergedKeys := make(map[string]entry)
-	segmentsToCompact := db.segments[:len(db.segments)-1]
-
-	for _, seg := range segmentsToCompact {
-		if err := processSegmentForCompaction(seg, mergedKeys); err != nil {
+	var keys *keyFileWriter
+	if db.opts.DiskIndex {
+		if keys, err = createKeyFile(mergedPath, db.keys); err != nil {
 			mergeFile.Close()
 			os.Remove(mergePath)
 			return err
 		}
 	}
+	var copied []hintEntry
+	var expiredKeys []string
+	var expiredCount int
+	emit := func(h hintEntry, isExpired bool) error {
+		switch {
+		case keys != nil:
+			if isExpired {
+				expiredCount++
+				return nil
+			}
+			return keys.add(h.key, SegmentPos{offset: h.offset, size: h.size, expiresAt: h.expiresAt, version: h.version})
+		case isExpired:
+			expiredKeys = append(expiredKeys, h.key)
+		default:
+			copied = append(copied, h)
+		}
+		return nil
+	}
 
-	if err := writeMergedData(mergeFile, mergedKeys); err != nil {
+	sources := make(map[int]*Segment, len(segmentsToCompact))
+	for _, seg := range segmentsToCompact {
+		sources[seg.num] = seg
+	}
+	now := time.Now().UnixNano()
+	mergedSize, err := writeMergedData(mergeFile, table.seek(""), sources, now, db.keys, emit)
+	if err == nil {
+		err = mergeFile.Sync()
+	}
+	if err == nil && keys != nil {
+		err = keys.finish(mergedSize)
+		keys = nil
+	}
+	if err != nil {
+		if keys != nil {
+			keys.abort()
+		}
 		mergeFile.Close()
 		os.Remove(mergePath)
+		os.Remove(keysPath(mergedPath))
 		return err
 	}
 
 	if err := mergeFile.Close(); err != nil {
 		os.Remove(mergePath)
+		os.Remove(keysPath(mergedPath))
 		return fmt.Errorf("failed to close merge file %s: %w", mergePath, err)
 	}
-
-	newSegmentOnePath := filepath.Join(db.dir, fmt.Sprintf("%s%04d", segmentPrefix, 1))
-	if err := os.Rename(mergePath, newSegmentOnePath); err != nil {
-		fmt.Fprintf(os.Stderr, "Error renaming %s to %s: %v\n", mergePath, newSegmentOnePath, err)
+	if err := os.Rename(mergePath, mergedPath); err != nil {
+		os.Remove(mergePath)
+		os.Remove(keysPath(mergedPath))
 		return err
 	}
 
-	currentActiveSeg := db.segments[len(db.segments)-1]
-	if err := currentActiveSeg.file.Close(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error closing current active segment file %s during compaction: %v\n", currentActiveSeg.file.Name(), err)
+	if !db.opts.DiskIndex {
+		if err := writeHintFile(mergedPath, mergedSize, copied, db.keys); err != nil {
+			db.logf("Failed to write hint file for merged segment: %v", err)
+		}
 	}
 
-	oldActiveSegPath := currentActiveSeg.file.Name()
-	newActiveSegNum := 2
-	newActiveSegPath := filepath.Join(db.dir, fmt.Sprintf("%s%04d", segmentPrefix, newActiveSegNum))
+	mergedSeg, err := db.openSegment(mergedNum)
+	if err == nil && db.opts.DiskIndex {
+		if mergedSeg.keys, err = openKeyFile(mergedPath, mergedNum, mergedSize, db.keys); err != nil {
+			mergedSeg.release()
+		}
+	}
+	if err != nil {
+		os.Remove(mergedPath)
+		os.Remove(hintPath(mergedPath))
+		os.Remove(keysPath(mergedPath))
+		return fmt.Errorf("failed to open merged segment %s: %w", mergedPath, err)
+	}
 
-	if oldActiveSegPath != newActiveSegPath {
-		if err := os.Rename(oldActiveSegPath, newActiveSegPath); err != nil {
-			fmt.Fprintf(os.Stderr, "Error renaming active segment %s to %s: %v\n", oldActiveSegPath, newActiveSegPath, err)
-			return err
+	// The index as it will be once the merged segment is in: the frozen copy
+	// with the copied records moved and the expired ones dropped.
+	index := table.index
+	var mergedLive int64
+	for _, h := range copied {
+		index.set(h.key, SegmentPos{segmentNum: mergedNum, offset: h.offset, expiresAt: h.expiresAt, version: h.version, size: h.size})
+		mergedLive += h.size
+	}
+	for _, key := range expiredKeys {
+		index.delete(key)
+	}
+
+	// Under the disk index, the keys written during the compaction are looked
+	// up without db.mu to find the merged records they replaced and the
+	// expired records dropped under them; only the keys written since are
+	// left for the swap. A write that failed and was rolled back counts as
+	// well, overstating the garbage and the key count until the next
+	// compaction.
+	var replaced replacedRecords
+	written := make(map[string]struct{})
+	if db.opts.DiskIndex {
+		db.mu.Lock()
+		writes := db.takeCompactionWrites(written)
+		db.mu.Unlock()
+		if err := replaced.add(writes, mergedSeg.keys, table, sources, now); err != nil {
+			db.logf("Failed to account for writes made during compaction: %v", err)
 		}
 	}
 
-	db.segments = make([]*Segment, 0)
-	db.index = make(map[string]SegmentPos)
+	// Holding db.manifestMu keeps the segment list as it is while the
+	// manifest is written without db.mu.
+	db.manifestMu.Lock()
+	defer db.manifestMu.Unlock()
 
-	files, err := os.ReadDir(db.dir)
-	if err != nil {
+	db.mu.Lock()
+	segments := append([]*Segment{mergedSeg}, db.segments[len(segmentsToCompact):]...)
+	db.mu.Unlock()
+	if err := db.saveManifest(segments); err != nil {
+		db.discardSegment(mergedSeg)
 		return err
 	}
 
-	var postCompactSegmentFiles []string
-	for _, f := range files {
-		name := f.Name()
-		if strings.HasPrefix(name, segmentPrefix) && !strings.HasSuffix(name, mergeSuffix) {
-			postCompactSegmentFiles = append(postCompactSegmentFiles, name)
+	db.mu.Lock()
+	db.segments = segments
+	db.segmentsGen++
+
+	if db.opts.DiskIndex {
+		if err := replaced.add(db.takeCompactionWrites(written), mergedSeg.keys, table, sources, now); err != nil {
+			db.logf("Failed to account for writes made during compaction: %v", err)
 		}
+		mergedSeg.liveBytes = mergedSize - replaced.shadowed
+		db.keyCount -= expiredCount - replaced.expired
+	} else {
+		mergedSeg.liveBytes = mergedLive
+		db.index = db.reconcileIndex(index, sources, mergedSeg)
+		db.keyCount = db.index.len()
 	}
+	db.mu.Unlock()
 
-	sort.Slice(postCompactSegmentFiles, func(i, j int) bool {
-		return extractNum(postCompactSegmentFiles[i]) < extractNum(postCompactSegmentFiles[j])
-	})
-
-	for _, segFile := range postCompactSegmentFiles {
-		seg, err := openSegment(db.dir, segFile)
-		if err != nil {
-			return fmt.Errorf("failed to open segment %s after compaction: %w", segFile, err)
+	// Snapshots and reads may still use the compacted segments; their files
+	// stay open until the last reference is released, even once removed from
+	// disk.
+	for _, seg := range segmentsToCompact {
+		path := seg.file.Name()
+		if err := seg.release(); err != nil {
+			db.logf("Error closing compacted segment: %v", err)
 		}
-		db.segments = append(db.segments, seg)
-		if err := db.recoverSegment(seg); err != nil {
-			return fmt.Errorf("failed to recover segment %s after compaction: %w", segFile, err)
+		for _, aux := range []string{hintPath(path), keysPath(path)} {
+			if err := os.Remove(aux); err != nil && !errors.Is(err, os.ErrNotExist) {
+				db.logf("Error removing %s of compacted segment %d: %v", filepath.Base(aux), seg.num, err)
+			}
 		}
-	}
-
-	if len(db.segments) == 0 {
-		seg, err := createNewSegment(db.dir, 1)
-		if err != nil {
-			return err
+		if err := os.Remove(path); err != nil {
+			db.logf("Error removing compacted segment %s: %v", path, err)
 		}
-		db.segments = append(db.segments, seg)
 	}
 
 	return nil
 }
 
-func processSegmentForCompaction(seg *Segment, mergedKeys map[string]entry) error {
-	file, err := os.Open(seg.file.Name())
-	if err != nil {
-		return err
+// reconcileIndex brings the keys written during a compaction into index,
+// which was built from the frozen copy the compaction started from, and
+// returns it. A key whose failed write was rolled back may point at a
+// compacted record again; index already has that record in the merged
+// segment. Must be called with db.mu held.
+func (db *Db) reconcileIndex(index keyIndex, compacted map[int]*Segment, merged *Segment) keyIndex {
+	for key := range db.compactionWrites {
+		pos, ok := db.index.get(key)
+		if ok && compacted[pos.segmentNum] != nil {
+			continue
+		}
+		if prev, found := index.get(key); found && prev.segmentNum == merged.num {
+			merged.liveBytes -= prev.size
+		}
+		if ok {
+			index.set(key, pos)
+		} else {
+			index.delete(key)
+		}
 	}
-	defer file.Close()
+	return index
+}
 
-	reader := bufio.NewReader(file)
-	for {
-		var record entry
-		_, err := record.DecodeFromReader(reader)
-		if errors.Is(err, io.EOF) {
-			break
+// writeMergedData copies the latest records of the keys in the source
+// segments to the merge file in key order, passing each one to emit. Deleted
+// keys have no such record and compaction always starts from the oldest
+// segment, so nothing left on disk can resurrect them. Expired records are
+// skipped but passed to emit as well, so that their index entries can be
+// removed.
+func writeMergedData(file *os.File, cur keyCursor, sources map[int]*Segment, now int64, ring *keyring, emit func(h hintEntry, expired bool) error) (size int64, err error) {
+	writer := bufio.NewWriter(file)
+
+	var buf []byte
+	for n, ok := cur.next(); ok; n, ok = cur.next() {
+		seg := sources[n.pos.segmentNum]
+		if seg == nil || n.pos.deleted {
+			continue
+		}
+		if n.pos.expired(now) {
+			if err := emit(hintEntry{key: n.key}, true); err != nil {
+				return 0, err
+			}
+			continue
 		}
+
+		var data []byte
+		data, buf, err = copyRecord(seg, n.key, n.pos, buf, ring)
 		if err != nil {
-			return err
+			return 0, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return 0, err
 		}
-		mergedKeys[record.key] = record
+		h := hintEntry{key: n.key, offset: size, size: int64(len(data)), expiresAt: n.pos.expiresAt, version: n.pos.version}
+		if err := emit(h, false); err != nil {
+			return 0, err
+		}
+		size += int64(len(data))
 	}
-	return nil
+	if err := cur.err(); err != nil {
+		return 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	return size, nil
 }
 
-func writeMergedData(file *os.File, data map[string]entry) error {
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
+// copyRecord reads the record at pos into buf, which is reused between calls,
+// and returns it as it goes into the merge file. The bytes are copied as they
+// are unless the record has to change: merged records are written one by one
+// rather than as the batch they may have been committed in, and records not
+// encrypted under the current key are re-encrypted.
+func copyRecord(seg *Segment, key string, pos SegmentPos, buf []byte, ring *keyring) ([]byte, []byte, error) {
+	if int64(cap(buf)) < pos.size {
+		buf = make([]byte, pos.size)
+	}
+	buf = buf[:pos.size]
+	if _, err := seg.file.ReadAt(buf, pos.offset); err != nil {
+		return nil, buf, fmt.Errorf("failed to read record at offset %d in segment %d for key %s: %w", pos.offset, seg.num, key, err)
+	}
 
-	keys := make([]string, 0, len(data))
-	for k := range data {
-		keys = append(keys, k)
+	kind, value, err := peekRecord(buf)
+	if err != nil {
+		return nil, buf, fmt.Errorf("failed to decode record at offset %d in segment %d for key %s: %w", pos.offset, seg.num, key, err)
+	}
+	if kind&flagContinued == 0 && !ring.stale(kind&flagEncrypted != 0, value) {
+		return buf, buf, nil
 	}
-	sort.Strings(keys)
 
-	for _, k := range keys {
-		record := data[k]
-		if _, err := writer.Write(record.Encode()); err != nil {
-			return err
-		}
+	var record entry
+	if err := record.Decode(buf); err != nil {
+		return nil, buf, fmt.Errorf("failed to decode record at offset %d in segment %d for key %s: %w", pos.offset, seg.num, key, err)
 	}
-	return nil
+	if err := ring.decrypt(&record); err != nil {
+		return nil, buf, fmt.Errorf("failed to decrypt record at offset %d in segment %d for key %s: %w", pos.offset, seg.num, key, err)
+	}
+	record.continued = false
+	ring.encrypt(&record)
+	return record.Encode(), buf, nil
 }
 
 func (db *Db) Close() error {
 	close(db.putRequests)
 	db.writerWg.Wait()
 
+	close(db.syncStop)
+	db.syncWg.Wait()
+	if db.opts.SyncPolicy == SyncInterval {
+		db.syncActiveSegment()
+	}
+
 	close(db.getRequests)
 	db.getWorkersWg.Wait()
 
@@ -520,10 +1026,8 @@ func (db *Db) Close() error {
 
 	var errs []error
 	for _, seg := range db.segments {
-		if seg.file != nil {
-			if err := seg.file.Close(); err != nil {
-				errs = append(errs, fmt.Errorf("failed to close segment file %s: %w", seg.file.Name(), err))
-			}
+		if err := seg.release(); err != nil {
+			errs = append(errs, err)
 		}
 	}
 	if len(errs) > 0 {
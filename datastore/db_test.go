@@ -1,10 +1,20 @@
 package datastore
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -247,6 +257,2052 @@ func TestDb(t *testing.T) {
 		}
 	})
 
+	t.Run("Compaction concurrent with writes", func(t *testing.T) {
+		for _, diskIndex := range []bool{false, true} {
+			tmpDir := filepath.Join(baseTmpDir, fmt.Sprintf("compaction_concurrent_%t", diskIndex))
+			opts := Options{MaxSegmentSize: 200, DiskIndex: diskIndex}
+			db, err := OpenWithOptions(tmpDir, opts)
+			if err != nil {
+				t.Fatalf("failed to open db: %v", err)
+			}
+
+			expected := make(map[string]string)
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("k%02d", i)
+				if err := db.Put(key, "initial"); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+				expected[key] = "initial"
+			}
+
+			done := make(chan struct{})
+			compactErr := make(chan error, 1)
+			go func() {
+				defer close(compactErr)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if err := db.performCompaction(); err != nil {
+						compactErr <- err
+						return
+					}
+				}
+			}()
+
+			for round := 0; round < 20; round++ {
+				for i := round % 3; i < 20; i += 3 {
+					key := fmt.Sprintf("k%02d", i)
+					if i%7 == 0 && expected[key] != "" {
+						if err := db.Delete(key); err != nil {
+							t.Fatalf("Delete failed: %v", err)
+						}
+						delete(expected, key)
+						continue
+					}
+					value := fmt.Sprintf("round%d", round)
+					if err := db.Put(key, value); err != nil {
+						t.Fatalf("Put failed: %v", err)
+					}
+					expected[key] = value
+				}
+				if got, err := db.Get("k01"); err != nil && !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Get during compaction failed: %q, %v", got, err)
+				}
+			}
+			close(done)
+			if err := <-compactErr; err != nil {
+				t.Fatalf("compaction failed: %v", err)
+			}
+
+			check := func(db *Db, stage string) {
+				for i := 0; i < 20; i++ {
+					key := fmt.Sprintf("k%02d", i)
+					got, err := db.Get(key)
+					if want, ok := expected[key]; ok {
+						if err != nil || got != want {
+							t.Errorf("%s: unexpected value for key=%s: %q, %v, want %q", stage, key, got, err, want)
+						}
+					} else if !errors.Is(err, ErrNotFound) {
+						t.Errorf("%s: expected ErrNotFound for key=%s, got %q, %v", stage, key, got, err)
+					}
+				}
+			}
+			check(db, "after compactions")
+			before, err := db.Stats()
+			if err != nil {
+				t.Fatalf("Stats failed: %v", err)
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close db: %v", err)
+			}
+			db, err = OpenWithOptions(tmpDir, opts)
+			if err != nil {
+				t.Fatalf("failed to reopen db: %v", err)
+			}
+			check(db, "after reopen")
+
+			// Open counts the live bytes from scratch.
+			after, err := db.Stats()
+			if err != nil {
+				t.Fatalf("Stats failed: %v", err)
+			}
+			if before.Keys != after.Keys || before.LiveBytes != after.LiveBytes {
+				t.Errorf("stats after compactions: %d keys, %d live bytes; after reopen: %d keys, %d live bytes", before.Keys, before.LiveBytes, after.Keys, after.LiveBytes)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close db: %v", err)
+			}
+		}
+	})
+
+	t.Run("Compaction memory does not grow with values", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "compaction_memory")
+		db, err := Open(tmpDir, 64*1024)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		value := strings.Repeat("v", 16*1024)
+		const keys = 100
+		for round := 0; round < 2; round++ {
+			for i := 0; i < keys; i++ {
+				if err := db.Put(fmt.Sprintf("key%03d", i), value); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+		}
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		if err := db.performCompaction(); err != nil {
+			t.Fatalf("compaction failed: %v", err)
+		}
+		runtime.ReadMemStats(&after)
+
+		live := int64(keys * len(value))
+		if allocated := int64(after.TotalAlloc - before.TotalAlloc); allocated > live/4 {
+			t.Errorf("compaction allocated %d bytes for %d bytes of live values", allocated, live)
+		}
+		for i := 0; i < keys; i += 17 {
+			if got, err := db.Get(fmt.Sprintf("key%03d", i)); err != nil || got != value {
+				t.Errorf("unexpected value for key%03d after compaction: %d bytes, %v", i, len(got), err)
+			}
+		}
+	})
+
+	t.Run("Delete with tombstones", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "delete")
+		db, err := Open(tmpDir, 20)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+
+		for _, p := range []struct{ key, value string }{
+			{"k1", "v1"}, {"k2", "v2"}, {"k3", "v3"}, {"k4", "v4"},
+		} {
+			if err := db.Put(p.key, p.value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		for _, key := range []string{"k1", "k3"} {
+			if err := db.Delete(key); err != nil {
+				t.Fatalf("Delete failed for key=%s: %v", key, err)
+			}
+		}
+		if err := db.Delete("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound deleting missing key, got %v", err)
+		}
+		if err := db.Put("k5", "v5"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+
+		checkDeleted := func(db *Db, stage string) {
+			for _, key := range []string{"k1", "k3"} {
+				if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s: expected ErrNotFound for deleted key=%s, got %v", stage, key, err)
+				}
+			}
+			for key, want := range map[string]string{"k2": "v2", "k4": "v4", "k5": "v5"} {
+				got, err := db.Get(key)
+				if err != nil {
+					t.Errorf("%s: Get failed for key=%s: %v", stage, key, err)
+				} else if got != want {
+					t.Errorf("%s: wrong value for key=%s: got=%s, want=%s", stage, key, got, want)
+				}
+			}
+		}
+		checkDeleted(db, "before reopen")
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		db, err = Open(tmpDir, 20)
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		checkDeleted(db, "after reopen")
+
+		sizeBefore, err := db.Size()
+		if err != nil {
+			t.Fatalf("Size failed: %v", err)
+		}
+		db.Compact()
+		db.compactionWg.Wait()
+		sizeAfter, err := db.Size()
+		if err != nil {
+			t.Fatalf("Size failed: %v", err)
+		}
+		if sizeAfter >= sizeBefore {
+			t.Errorf("expected compaction to purge deleted records, before=%d, after=%d", sizeBefore, sizeAfter)
+		}
+		checkDeleted(db, "after compaction")
+	})
+
+	t.Run("Corrupted record returns ErrCorrupted", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "corrupted")
+		db, err := Open(tmpDir, 1024)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		if err := db.Put("k1", "v1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		f, err := os.OpenFile(db.getActiveSegment().file.Name(), os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open segment file: %v", err)
+		}
+		if _, err := f.WriteAt([]byte("X"), int64(headerSize+len("k1"))); err != nil {
+			t.Fatalf("failed to corrupt segment file: %v", err)
+		}
+		_ = f.Close()
+
+		if _, err := db.Get("k1"); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("expected ErrCorrupted, got %v", err)
+		}
+	})
+
+	t.Run("Recovery truncates torn write", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "torn_write")
+		db, err := Open(tmpDir, 1024)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		if err := db.Put("k1", "v1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		segPath := db.getActiveSegment().file.Name()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		torn := entry{key: "k2", value: "v2"}
+		f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("failed to open segment file: %v", err)
+		}
+		if _, err := f.Write(torn.Encode()[:10]); err != nil {
+			t.Fatalf("failed to append torn record: %v", err)
+		}
+		_ = f.Close()
+
+		db, err = Open(tmpDir, 1024)
+		if err != nil {
+			t.Fatalf("expected Open to recover from torn write, got %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		if got, err := db.Get("k1"); err != nil || got != "v1" {
+			t.Errorf("unexpected k1 after recovery: %q, %v", got, err)
+		}
+		if _, err := db.Get("k2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected torn k2 to be discarded, got %v", err)
+		}
+		if err := db.Put("k3", "v3"); err != nil {
+			t.Fatalf("Put after recovery failed: %v", err)
+		}
+		if got, err := db.Get("k3"); err != nil || got != "v3" {
+			t.Errorf("unexpected k3 after recovery: %q, %v", got, err)
+		}
+	})
+
+	t.Run("Recovery fails on damaged size in last segment", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "damaged_size")
+		db, err := Open(tmpDir, 1024)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		var offsets []int64
+		for i := 0; i < 5; i++ {
+			offsets = append(offsets, db.getActiveSegment().offset)
+			if err := db.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		segPath := db.getActiveSegment().file.Name()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		if err := os.Remove(hintPath(segPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("failed to remove hint file: %v", err)
+		}
+
+		// A size pointing past the end of the file makes k1 look like a torn
+		// write, yet k2..k4 follow it.
+		f, err := os.OpenFile(segPath, os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open segment file: %v", err)
+		}
+		if _, err := f.WriteAt([]byte{0xff, 0xff, 0x00, 0x01}, offsets[1]); err != nil {
+			t.Fatalf("failed to damage record: %v", err)
+		}
+		_ = f.Close()
+		before, err := os.Stat(segPath)
+		if err != nil {
+			t.Fatalf("failed to stat segment: %v", err)
+		}
+
+		if db, err := Open(tmpDir, 1024); err == nil {
+			db.Close()
+			t.Fatal("expected Open to fail instead of discarding acknowledged records")
+		}
+		if after, err := os.Stat(segPath); err != nil || after.Size() != before.Size() {
+			t.Errorf("expected the segment to be left untouched, got %v", err)
+		}
+	})
+
+	t.Run("Recovery fails on checksum mismatch in last record", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "last_record_checksum")
+		db, err := Open(tmpDir, 1024, WithSyncPolicy(SyncAlways, 0))
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		if err := db.Put("k1", "v1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := db.Put("k2", "v2"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		segPath := db.getActiveSegment().file.Name()
+		size := db.getActiveSegment().offset
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		// A bit flip in the value of the acknowledged, synced last record.
+		f, err := os.OpenFile(segPath, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatalf("failed to open segment file: %v", err)
+		}
+		if _, err := f.WriteAt([]byte{'x'}, size-1); err != nil {
+			t.Fatalf("failed to damage record: %v", err)
+		}
+		_ = f.Close()
+
+		if db, err := Open(tmpDir, 1024); !errors.Is(err, ErrCorrupted) {
+			if err == nil {
+				db.Close()
+			}
+			t.Fatalf("expected Open to fail with ErrCorrupted, got %v", err)
+		}
+		if info, err := os.Stat(segPath); err != nil || info.Size() != size {
+			t.Errorf("expected the segment to be left untouched, got %v", err)
+		}
+	})
+
+	t.Run("Recovery fails on corruption in sealed segment", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "sealed_corruption")
+		db, err := Open(tmpDir, 20)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		for _, key := range []string{"k1", "k2"} {
+			if err := db.Put(key, "value"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		sealedPath := db.segments[0].file.Name()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		f, err := os.OpenFile(sealedPath, os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open segment file: %v", err)
+		}
+		if _, err := f.WriteAt([]byte("X"), headerSize); err != nil {
+			t.Fatalf("failed to corrupt segment file: %v", err)
+		}
+		_ = f.Close()
+		// Without the hint file Open has to scan the sealed segment.
+		if err := os.Remove(hintPath(sealedPath)); err != nil {
+			t.Fatalf("failed to remove hint file: %v", err)
+		}
+
+		if db, err := Open(tmpDir, 20); !errors.Is(err, ErrCorrupted) {
+			if err == nil {
+				_ = db.Close()
+			}
+			t.Errorf("expected Open to fail with ErrCorrupted, got %v", err)
+		}
+	})
+
+	t.Run("Hint files", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "hints")
+		db, err := Open(tmpDir, 20)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		for _, p := range []struct{ key, value string }{
+			{"k1", "v1"}, {"k2", "v2"}, {"k1", "v1.1"}, {"k3", "v3"},
+		} {
+			if err := db.Put(p.key, p.value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := db.Delete("k2"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if err := db.Put("k4", "v4"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+
+		var sealed []string
+		for _, seg := range db.segments[:len(db.segments)-1] {
+			sealed = append(sealed, seg.file.Name())
+			if _, err := os.Stat(hintPath(seg.file.Name())); err != nil {
+				t.Errorf("expected hint file for sealed segment %d: %v", seg.num, err)
+			}
+		}
+		if _, err := os.Stat(hintPath(db.getActiveSegment().file.Name())); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no hint file for the active segment, got %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		expected := map[string]string{"k1": "v1.1", "k3": "v3", "k4": "v4"}
+		check := func(stage string) {
+			db, err := Open(tmpDir, 20)
+			if err != nil {
+				t.Fatalf("%s: failed to reopen db: %v", stage, err)
+			}
+			defer db.Close()
+			for key, want := range expected {
+				if got, err := db.Get(key); err != nil || got != want {
+					t.Errorf("%s: unexpected value for key=%s: %q, %v", stage, key, got, err)
+				}
+			}
+			if _, err := db.Get("k2"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: expected ErrNotFound for deleted key, got %v", stage, err)
+			}
+		}
+		check("with hints")
+
+		// A hint that does not match its segment must be ignored.
+		if err := writeHintFile(sealed[0], 1, []hintEntry{{key: "bogus"}}, nil); err != nil {
+			t.Fatalf("failed to write stale hint: %v", err)
+		}
+		if err := os.Remove(hintPath(sealed[1])); err != nil {
+			t.Fatalf("failed to remove hint: %v", err)
+		}
+		check("with stale and missing hints")
+		if _, err := os.Stat(hintPath(sealed[1])); err != nil {
+			t.Errorf("expected missing hint file to be rebuilt: %v", err)
+		}
+	})
+
+	t.Run("Sync policies", func(t *testing.T) {
+		for _, policy := range []SyncPolicy{SyncNever, SyncAlways, SyncInterval} {
+			tmpDir := filepath.Join(baseTmpDir, "sync_"+policy.String())
+			db, err := Open(tmpDir, 64, WithSyncPolicy(policy, 5*time.Millisecond))
+			if err != nil {
+				t.Fatalf("%v: failed to open db: %v", policy, err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatalf("%v: Put failed: %v", policy, err)
+				}
+			}
+			if policy == SyncInterval {
+				time.Sleep(20 * time.Millisecond)
+				db.mu.Lock()
+				dirty := db.dirty
+				db.mu.Unlock()
+				if dirty {
+					t.Errorf("%v: expected background sync to flush the active segment", policy)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("%v: failed to close db: %v", policy, err)
+			}
+
+			db, err = Open(tmpDir, 64, WithSyncPolicy(policy, 5*time.Millisecond))
+			if err != nil {
+				t.Fatalf("%v: failed to reopen db: %v", policy, err)
+			}
+			for i := 0; i < 10; i++ {
+				key, want := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+				if got, err := db.Get(key); err != nil || got != want {
+					t.Errorf("%v: unexpected value for key=%s: %q, %v", policy, key, got, err)
+				}
+			}
+			_ = db.Close()
+		}
+
+		if _, err := Open(filepath.Join(baseTmpDir, "sync_invalid"), 64, WithSyncPolicy(SyncInterval, 0)); err == nil {
+			t.Error("expected Open to reject a non-positive sync interval")
+		}
+		if p, err := ParseSyncPolicy("interval"); err != nil || p != SyncInterval {
+			t.Errorf("ParseSyncPolicy(interval) = %v, %v", p, err)
+		}
+		if _, err := ParseSyncPolicy("sometimes"); err == nil {
+			t.Error("expected ParseSyncPolicy to reject an unknown policy")
+		}
+	})
+
+	t.Run("Group commit", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "group_commit")
+		db, err := Open(tmpDir, 64)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		group := []putRequest{
+			{key: "k1", value: "v1"},
+			{key: "k1", deleted: true},
+			{key: "k1", deleted: true},
+			{key: "k2", value: "v2"},
+			{key: "k3", value: "v3"},
+			{key: "k4", value: "v4"},
+			{key: "k2", value: "v2.1"},
+		}
+		db.mu.Lock()
+		errs := db.commitGroup(group)
+		segments := len(db.segments)
+		db.mu.Unlock()
+
+		for i, err := range errs {
+			if i == 2 {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("expected ErrNotFound for deleting an already deleted key, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("request %d failed: %v", i, err)
+			}
+		}
+		if segments < 2 {
+			t.Errorf("expected the group to roll over to a new segment, got %d segments", segments)
+		}
+
+		if _, err := db.Get("k1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for k1, got %v", err)
+		}
+		for key, want := range map[string]string{"k2": "v2.1", "k3": "v3", "k4": "v4"} {
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("unexpected value for key=%s: %q, %v", key, got, err)
+			}
+		}
+	})
+
+	t.Run("Write batches", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "write_batch")
+		db, err := Open(tmpDir, 64)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		if err := db.Put("k1", "v1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+
+		var b WriteBatch
+		b.Put("k2", "v2")
+		b.Put("k3", "v3")
+		b.Delete("k1")
+		b.Delete("missing")
+		b.Put("k4", "v4")
+		b.Delete("k4")
+		if err := db.Write(&b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		expected := map[string]string{"k2": "v2", "k3": "v3"}
+		check := func(db *Db, stage string) {
+			for key, want := range expected {
+				if got, err := db.Get(key); err != nil || got != want {
+					t.Errorf("%s: unexpected value for key=%s: %q, %v", stage, key, got, err)
+				}
+			}
+			for _, key := range []string{"k1", "k4", "k5", "k6"} {
+				if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s: expected ErrNotFound for key=%s, got %v", stage, key, err)
+				}
+			}
+		}
+		check(db, "after write")
+
+		segPath := db.getActiveSegment().file.Name()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		// Simulate a crash in the middle of writing another batch.
+		var torn []byte
+		for _, e := range []entry{
+			{key: "k5", value: "v5", continued: true},
+			{key: "k2", deleted: true, continued: true},
+			{key: "k6", value: "v6"},
+		} {
+			torn = append(torn, e.Encode()...)
+		}
+		f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("failed to open segment file: %v", err)
+		}
+		if _, err := f.Write(torn[:len(torn)-3]); err != nil {
+			t.Fatalf("failed to append torn batch: %v", err)
+		}
+		_ = f.Close()
+
+		db, err = Open(tmpDir, 64)
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		check(db, "after torn batch")
+
+		for i := 0; i < 5; i++ {
+			if err := db.Put(fmt.Sprintf("filler%d", i), "value"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		db.Compact()
+		db.compactionWg.Wait()
+		check(db, "after compaction")
+	})
+
+	t.Run("Ordered scans", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "scan")
+		db, err := Open(tmpDir, 64)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		for _, key := range []string{"server3", "a", "server1", "server10", "server2", "z", "server2"} {
+			if err := db.Put(key, "v-"+key); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := db.Delete("server10"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+
+		collect := func(it *Iterator) []string {
+			var keys []string
+			for it.Next() {
+				if it.Value() != "v-"+it.Key() {
+					t.Errorf("unexpected value for key=%s: %s", it.Key(), it.Value())
+				}
+				keys = append(keys, it.Key())
+			}
+			if err := it.Err(); err != nil {
+				t.Errorf("iteration failed: %v", err)
+			}
+			return keys
+		}
+
+		it := db.ScanPrefix("server")
+		if err := db.Put("server4", "v-server4"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if got, want := fmt.Sprint(collect(it)), "[server1 server2 server3]"; got != want {
+			t.Errorf("ScanPrefix = %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(collect(db.Scan("b", "server3", 0))), "[server1 server2]"; got != want {
+			t.Errorf("Scan(b, server3) = %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(collect(db.Scan("", "", 3))), "[a server1 server2]"; got != want {
+			t.Errorf("Scan with limit = %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(collect(db.Scan("server4\x00", "", 0))), "[z]"; got != want {
+			t.Errorf("Scan after server4 = %s, want %s", got, want)
+		}
+
+		if got := PrefixEnd("ab\xff"); got != "ac" {
+			t.Errorf("PrefixEnd = %q, want %q", got, "ac")
+		}
+		if got := PrefixEnd("\xff\xff"); got != "" {
+			t.Errorf("PrefixEnd = %q, want empty", got)
+		}
+	})
+
+	t.Run("Snapshots", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "snapshot")
+		db, err := Open(tmpDir, 20)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		for _, p := range []struct{ key, value string }{
+			{"k1", "v1"}, {"k2", "v2"}, {"k3", "v3"},
+		} {
+			if err := db.Put(p.key, p.value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+
+		snap := db.Snapshot()
+		compacted := db.segments[:len(db.segments)-1]
+
+		if err := db.Put("k1", "v1.1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := db.Delete("k2"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if err := db.Put("k4", "v4"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		db.Compact()
+		db.compactionWg.Wait()
+
+		expected := map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"}
+		for key, want := range expected {
+			if got, err := snap.Get(key); err != nil || got != want {
+				t.Errorf("snapshot: unexpected value for key=%s: %q, %v", key, got, err)
+			}
+		}
+		if _, err := snap.Get("k4"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("snapshot: expected ErrNotFound for k4, got %v", err)
+		}
+		var keys []string
+		it := snap.ScanPrefix("k")
+		for it.Next() {
+			keys = append(keys, it.Key()+"="+it.Value())
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("snapshot scan failed: %v", err)
+		}
+		if got, want := fmt.Sprint(keys), "[k1=v1 k2=v2 k3=v3]"; got != want {
+			t.Errorf("snapshot scan = %s, want %s", got, want)
+		}
+
+		if got, err := db.Get("k1"); err != nil || got != "v1.1" {
+			t.Errorf("db: unexpected value for k1: %q, %v", got, err)
+		}
+		if _, err := db.Get("k2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("db: expected ErrNotFound for k2, got %v", err)
+		}
+
+		snap.Release()
+		snap.Release()
+		for _, seg := range compacted {
+			if refs := seg.refs.Load(); refs != 0 {
+				t.Errorf("segment %d still has %d references after release", seg.num, refs)
+			}
+		}
+		if _, err := snap.Get("k1"); err == nil {
+			t.Error("expected Get on a released snapshot to fail")
+		}
+
+		// A key that expires after the snapshot is taken stays in it.
+		if err := db.PutWithTTL("short", "lived", 50*time.Millisecond); err != nil {
+			t.Fatalf("PutWithTTL failed: %v", err)
+		}
+		snap = db.Snapshot()
+		defer snap.Release()
+		time.Sleep(100 * time.Millisecond)
+		if _, err := db.Get("short"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("db: expected ErrNotFound for expired key, got %v", err)
+		}
+		if got, err := snap.Get("short"); err != nil || got != "lived" {
+			t.Errorf("snapshot: unexpected value for key that expired after it was taken: %q, %v", got, err)
+		}
+		it = snap.ScanPrefix("short")
+		if !it.Next() || it.Key() != "short" {
+			t.Errorf("snapshot scan: expected key that expired after it was taken, got %v", it.Err())
+		}
+		it.Close()
+	})
+
+	t.Run("TTL expiry", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "ttl")
+		db, err := Open(tmpDir, 20)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+
+		if err := db.Put("k1", "v1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := db.PutWithTTL("k1", "v1-short", 50*time.Millisecond); err != nil {
+			t.Fatalf("PutWithTTL failed: %v", err)
+		}
+		if err := db.PutWithTTL("k2", "v2-long", time.Hour); err != nil {
+			t.Fatalf("PutWithTTL failed: %v", err)
+		}
+		if err := db.PutWithTTL("k3", "v3", 0); err == nil {
+			t.Error("expected PutWithTTL to reject a non-positive ttl")
+		}
+		if got, err := db.Get("k1"); err != nil || got != "v1-short" {
+			t.Errorf("unexpected value for k1 before expiry: %q, %v", got, err)
+		}
+
+		time.Sleep(60 * time.Millisecond)
+		if err := db.Put("k4", "v4"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+
+		check := func(db *Db, stage string) {
+			if _, err := db.Get("k1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: expected ErrNotFound for expired k1, got %v", stage, err)
+			}
+			if got, err := db.Get("k2"); err != nil || got != "v2-long" {
+				t.Errorf("%s: unexpected value for k2: %q, %v", stage, got, err)
+			}
+			var keys []string
+			it := db.Scan("", "", 0)
+			for it.Next() {
+				keys = append(keys, it.Key())
+			}
+			if got, want := fmt.Sprint(keys), "[k2 k4]"; got != want {
+				t.Errorf("%s: Scan = %s, want %s", stage, got, want)
+			}
+		}
+		check(db, "after expiry")
+		if err := db.Delete("k1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound deleting expired key, got %v", err)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		db, err = Open(tmpDir, 20)
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		check(db, "after reopen")
+
+		db.Compact()
+		db.compactionWg.Wait()
+		check(db, "after compaction")
+		records := 0
+		it := db.Scan("", "", 0)
+		for it.Next() {
+			records++
+		}
+		if size, err := db.Size(); err != nil || size > int64(records*(headerSize+10)) {
+			t.Errorf("expected compaction to drop expired records, size=%d, %v", size, err)
+		}
+	})
+
+	t.Run("Conditional writes", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "conditional")
+		db, err := Open(tmpDir, 40)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+
+		if err := db.PutIfVersion("k1", "v1", 0); err != nil {
+			t.Fatalf("PutIfVersion on absent key failed: %v", err)
+		}
+		if err := db.PutIfVersion("k1", "v1-again", 0); !errors.Is(err, ErrConflict) {
+			t.Errorf("expected ErrConflict creating existing key, got %v", err)
+		}
+		if err := db.Put("k1", "v1.1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if value, version, err := db.GetVersioned("k1"); err != nil || value != "v1.1" || version != 2 {
+			t.Errorf("GetVersioned = %q, %d, %v, want v1.1, 2", value, version, err)
+		}
+		if err := db.PutIfVersion("k1", "stale", 1); !errors.Is(err, ErrConflict) {
+			t.Errorf("expected ErrConflict for stale version, got %v", err)
+		}
+		if err := db.PutIfVersion("k1", "v1.2", 2); err != nil {
+			t.Errorf("PutIfVersion with current version failed: %v", err)
+		}
+
+		if err := db.CompareAndSwap("k1", "v1.1", "wrong"); !errors.Is(err, ErrConflict) {
+			t.Errorf("expected ErrConflict for mismatched value, got %v", err)
+		}
+		if err := db.CompareAndSwap("missing", "", "v"); !errors.Is(err, ErrConflict) {
+			t.Errorf("expected ErrConflict for missing key, got %v", err)
+		}
+		if err := db.CompareAndSwap("k1", "v1.2", "v1.3"); err != nil {
+			t.Errorf("CompareAndSwap failed: %v", err)
+		}
+		if err := db.PutIfExists("missing", "v"); !errors.Is(err, ErrConflict) {
+			t.Errorf("expected ErrConflict for PutIfExists on missing key, got %v", err)
+		}
+		if err := db.PutIfExists("k1", "v1.4"); err != nil {
+			t.Errorf("PutIfExists failed: %v", err)
+		}
+		if err := db.CompareAndSwap("k1", "v1.4", "v1.3"); err != nil {
+			t.Errorf("CompareAndSwap after PutIfExists failed: %v", err)
+		}
+
+		if err := db.Delete("k1"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if err := db.PutIfVersion("k1", "v1-new", 0); err != nil {
+			t.Errorf("PutIfVersion after delete failed: %v", err)
+		}
+
+		// Concurrent increments only all succeed if no swap is lost.
+		if err := db.Put("counter", "0"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 25; {
+					cur, err := db.Get("counter")
+					if err != nil {
+						t.Errorf("Get failed: %v", err)
+						return
+					}
+					var n int
+					fmt.Sscan(cur, &n)
+					err = db.CompareAndSwap("counter", cur, fmt.Sprint(n+1))
+					if errors.Is(err, ErrConflict) {
+						continue
+					}
+					if err != nil {
+						t.Errorf("CompareAndSwap failed: %v", err)
+						return
+					}
+					j++
+				}
+			}()
+		}
+		wg.Wait()
+
+		check := func(db *Db, stage string) {
+			if value, version, err := db.GetVersioned("k1"); err != nil || value != "v1-new" || version != 1 {
+				t.Errorf("%s: GetVersioned(k1) = %q, %d, %v, want v1-new, 1", stage, value, version, err)
+			}
+			if value, version, err := db.GetVersioned("counter"); err != nil || value != "100" || version != 101 {
+				t.Errorf("%s: GetVersioned(counter) = %q, %d, %v, want 100, 101", stage, value, version, err)
+			}
+		}
+		check(db, "after writes")
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		db, err = Open(tmpDir, 40)
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		check(db, "after reopen")
+
+		db.Compact()
+		db.compactionWg.Wait()
+		check(db, "after compaction")
+	})
+
+	t.Run("Int64 counters", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "counters")
+		db, err := Open(tmpDir, 40)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+
+		if n, err := db.Increment("hits", 5); err != nil || n != 5 {
+			t.Errorf("Increment of missing key = %d, %v, want 5", n, err)
+		}
+		if err := db.PutInt64("balance", -10); err != nil {
+			t.Fatalf("PutInt64 failed: %v", err)
+		}
+		if err := db.Put("legacy", "7"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if n, err := db.Increment("legacy", 1); err != nil || n != 8 {
+			t.Errorf("Increment of decimal string = %d, %v, want 8", n, err)
+		}
+		if err := db.Put("text", "abc"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if _, err := db.Increment("text", 1); !errors.Is(err, ErrNotInt64) {
+			t.Errorf("expected ErrNotInt64, got %v", err)
+		}
+		if _, err := db.GetInt64("text"); !errors.Is(err, ErrNotInt64) {
+			t.Errorf("expected ErrNotInt64, got %v", err)
+		}
+		if err := db.PutInt64("max", math.MaxInt64); err != nil {
+			t.Fatalf("PutInt64 failed: %v", err)
+		}
+		if _, err := db.Increment("max", 1); !errors.Is(err, ErrOverflow) {
+			t.Errorf("expected ErrOverflow, got %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 25; j++ {
+					if _, err := db.Increment("hits", 1); err != nil {
+						t.Errorf("Increment failed: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		check := func(db *Db, stage string) {
+			for key, want := range map[string]int64{"hits": 105, "balance": -10, "legacy": 8, "max": math.MaxInt64} {
+				if got, err := db.GetInt64(key); err != nil || got != want {
+					t.Errorf("%s: GetInt64(%s) = %d, %v, want %d", stage, key, got, err, want)
+				}
+			}
+			if got, err := db.Get("balance"); err != nil || got != "-10" {
+				t.Errorf("%s: Get(balance) = %q, %v, want -10", stage, got, err)
+			}
+		}
+		check(db, "after writes")
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		db, err = Open(tmpDir, 40)
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		check(db, "after reopen")
+
+		db.Compact()
+		db.compactionWg.Wait()
+		check(db, "after compaction")
+	})
+
+	t.Run("Compression", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "compression")
+		db, err := Open(tmpDir, 4096, WithCompression(64))
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+
+		large := strings.Repeat(`{"field":"value"},`, 100)
+		expected := map[string]string{"large": large, "small": "v", "large2": large + "!"}
+		for key, value := range expected {
+			if err := db.Put(key, value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if size, err := db.Size(); err != nil || size >= int64(2*len(large)) {
+			t.Errorf("expected values to be stored compressed, size=%d, %v", size, err)
+		}
+		if err := db.CompareAndSwap("large2", large+"!", large+"?"); err != nil {
+			t.Errorf("CompareAndSwap on compressed value failed: %v", err)
+		}
+		expected["large2"] = large + "?"
+
+		check := func(db *Db, stage string) {
+			for key, want := range expected {
+				if got, err := db.Get(key); err != nil || got != want {
+					t.Errorf("%s: unexpected value for key=%s: %d bytes, %v", stage, key, len(got), err)
+				}
+			}
+		}
+		check(db, "after writes")
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		// Compressed records are readable without the option as well.
+		db, err = Open(tmpDir, 4096)
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		check(db, "after reopen")
+
+		for i := 0; i < 50 && len(db.segments) < 2; i++ {
+			if err := db.Put(fmt.Sprintf("filler%d", i), strings.Repeat("x", 100)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		db.Compact()
+		db.compactionWg.Wait()
+		check(db, "after compaction")
+
+		if _, err := Open(filepath.Join(baseTmpDir, "compression_invalid"), 4096, WithCompression(-1)); err == nil {
+			t.Error("expected Open to reject a negative compression threshold")
+		}
+	})
+
+	t.Run("Value cache", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "value_cache")
+		db, err := Open(tmpDir, 200, WithCache(64))
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		expectGet := func(key, want string) {
+			t.Helper()
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("unexpected value for key=%s: %q, %v", key, got, err)
+			}
+		}
+		expectStats := func(hits, misses uint64) {
+			t.Helper()
+			if stats := db.CacheStats(); stats.Hits != hits || stats.Misses != misses {
+				t.Errorf("cache stats = %+v, want %d hits and %d misses", stats, hits, misses)
+			}
+		}
+
+		if err := db.Put("hot", "v1"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		expectGet("hot", "v1")
+		expectGet("hot", "v1")
+		expectStats(1, 1)
+
+		if err := db.Put("hot", "v2"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		expectGet("hot", "v2")
+		expectGet("hot", "v2")
+		expectStats(2, 2)
+
+		// A value as large as the whole cache evicts everything else.
+		if err := db.Put("big", strings.Repeat("b", 61)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		expectGet("big", strings.Repeat("b", 61))
+		if stats := db.CacheStats(); stats.Entries != 1 || stats.Bytes != 64 {
+			t.Errorf("expected only the large value to be cached, got %+v", stats)
+		}
+		expectGet("hot", "v2")
+		expectStats(2, 4)
+
+		if err := db.Delete("hot"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if _, err := db.Get("hot"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for a deleted key, got %v", err)
+		}
+
+		for i := 0; len(db.segments) < 3; i++ {
+			if err := db.Put(fmt.Sprintf("filler%d", i), "x"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := db.Put("moved", "m"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		expectGet("moved", "m")
+		for n := len(db.segments); len(db.segments) == n; {
+			if err := db.Put("filler", "x"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		db.Compact()
+		db.compactionWg.Wait()
+		before := db.CacheStats()
+		expectGet("moved", "m")
+		if after := db.CacheStats(); after.Misses != before.Misses+1 {
+			t.Errorf("expected a miss for a key moved by compaction, got %+v after %+v", after, before)
+		}
+
+		if _, err := Open(filepath.Join(baseTmpDir, "value_cache_invalid"), 200, WithCache(-1)); err == nil {
+			t.Error("expected Open to reject a negative cache size")
+		}
+	})
+
+	t.Run("Encryption", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "encryption")
+		oldKeys, err := ParseEncryptionKeys("1:" + strings.Repeat("ab", 32))
+		if err != nil {
+			t.Fatalf("ParseEncryptionKeys failed: %v", err)
+		}
+		rotatedKeys, err := ParseEncryptionKeys("1:" + strings.Repeat("ab", 32) + ", 2:" + strings.Repeat("cd", 16))
+		if err != nil {
+			t.Fatalf("ParseEncryptionKeys failed: %v", err)
+		}
+		if _, err := ParseEncryptionKeys("1=abcd"); err == nil {
+			t.Error("expected ParseEncryptionKeys to reject a malformed key")
+		}
+
+		db, err := Open(tmpDir, 100, WithEncryption(oldKeys...), WithCompression(16))
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		expected := map[string]string{}
+		for i := 0; i < 5; i++ {
+			key, value := fmt.Sprintf("secret%d", i), strings.Repeat(fmt.Sprintf("classified%d ", i), 5)
+			if err := db.Put(key, value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			expected[key] = value
+		}
+		if _, err := db.Increment("secret-counter", 7); err != nil {
+			t.Fatalf("Increment failed: %v", err)
+		}
+
+		check := func(db *Db, stage string) {
+			for key, want := range expected {
+				if got, err := db.Get(key); err != nil || got != want {
+					t.Errorf("%s: unexpected value for key=%s: %q, %v", stage, key, got, err)
+				}
+			}
+			if got, err := db.GetInt64("secret-counter"); err != nil || got != 7 {
+				t.Errorf("%s: GetInt64 = %d, %v, want 7", stage, got, err)
+			}
+		}
+		checkFiles := func(stage string) {
+			files, _ := os.ReadDir(tmpDir)
+			for _, f := range files {
+				data, err := os.ReadFile(filepath.Join(tmpDir, f.Name()))
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", f.Name(), err)
+				}
+				if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("classified")) {
+					t.Errorf("%s: %s contains plaintext", stage, f.Name())
+				}
+			}
+		}
+		check(db, "after writes")
+		checkFiles("after writes")
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		if _, err := Open(tmpDir, 100); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("expected Open without keys to fail with ErrUnknownKey, got %v", err)
+		}
+
+		db, err = Open(tmpDir, 100, WithEncryption(rotatedKeys...))
+		if err != nil {
+			t.Fatalf("failed to reopen db with rotated keys: %v", err)
+		}
+		check(db, "after rotation")
+		// Seal the segment still holding records under the old key.
+		for n := len(db.segments); len(db.segments) == n; {
+			if err := db.Put("secret-filler", "x"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		expected["secret-filler"] = "x"
+		db.Compact()
+		db.compactionWg.Wait()
+		check(db, "after compaction")
+		checkFiles("after compaction")
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		db, err = Open(tmpDir, 100, WithEncryption(rotatedKeys[1]))
+		if err != nil {
+			t.Fatalf("failed to reopen db with the new key only: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		check(db, "without old key")
+	})
+
+	t.Run("Automatic compaction", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "auto_compaction")
+		db, err := Open(tmpDir, 60)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		for _, key := range []string{"k1", "k2", "k3", "k1", "k1"} {
+			if err := db.Put(key, "value-"+key); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := db.Delete("k2"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		garbage := func(db *Db) (int64, int64) {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			return db.sealedGarbage()
+		}
+		before, total := garbage(db)
+		if before == 0 || before >= total {
+			t.Errorf("unexpected garbage accounting: %d of %d bytes", before, total)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		policy := CompactionPolicy{GarbageRatio: 0.5, MinInterval: time.Hour}
+		db, err = Open(tmpDir, 60, WithAutoCompaction(policy))
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		if after, _ := garbage(db); after != before {
+			t.Errorf("garbage after reopen = %d, want %d", after, before)
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := db.Put("k1", fmt.Sprintf("value-k1-%d", i)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		lastCompaction := func() time.Time {
+			db.compactionMu.Lock()
+			defer db.compactionMu.Unlock()
+			return db.lastCompaction
+		}
+		// The writer starts the compaction after acknowledging the write.
+		deadline := time.Now().Add(5 * time.Second)
+		for lastCompaction().IsZero() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		db.compactionWg.Wait()
+		first := lastCompaction()
+		if first.IsZero() {
+			t.Fatal("expected garbage to trigger a compaction")
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := db.Put("k1", fmt.Sprintf("value-k1-again-%d", i)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		db.compactionWg.Wait()
+		if !lastCompaction().Equal(first) {
+			t.Error("expected the minimum interval to hold back another compaction")
+		}
+
+		for key, want := range map[string]string{"k1": "value-k1-again-9", "k3": "value-k3"} {
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("unexpected value for key=%s: %q, %v", key, got, err)
+			}
+		}
+		if _, err := db.Get("k2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for k2, got %v", err)
+		}
+
+		if _, err := Open(filepath.Join(baseTmpDir, "auto_compaction_invalid"), 60, WithAutoCompaction(CompactionPolicy{GarbageRatio: 2})); err == nil {
+			t.Error("expected Open to reject a garbage ratio above 1")
+		}
+	})
+
+	t.Run("Manifest", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "manifest")
+		db, err := Open(tmpDir, 60)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		for _, key := range []string{"gone", "k1", "k2", "k3"} {
+			if err := db.Put(key, "value-"+key); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := db.Delete("gone"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		db.Compact()
+		db.compactionWg.Wait()
+		db.mu.Lock()
+		first := db.segments[0]
+		db.mu.Unlock()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		// A crash during compaction leaves a merged segment the manifest does
+		// not list yet, while the tombstone for "gone" is already gone from
+		// it. Replaying it would bring the key back.
+		data, err := os.ReadFile(first.file.Name())
+		if err != nil {
+			t.Fatalf("failed to read segment: %v", err)
+		}
+		var stale entry
+		stale.key, stale.value, stale.version = "gone", "value-gone", 1
+		orphans := []string{segmentName(90), segmentName(91) + mergeSuffix}
+		for _, name := range orphans {
+			if err := os.WriteFile(filepath.Join(tmpDir, name), append(data, stale.Encode()...), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", name, err)
+			}
+		}
+
+		check := func(db *Db, stage string) {
+			for _, key := range []string{"k1", "k2", "k3"} {
+				if got, err := db.Get(key); err != nil || got != "value-"+key {
+					t.Errorf("%s: unexpected value for key=%s: %q, %v", stage, key, got, err)
+				}
+			}
+			if _, err := db.Get("gone"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: expected ErrNotFound for a deleted key, got %v", stage, err)
+			}
+		}
+
+		db, err = Open(tmpDir, 60)
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		check(db, "after crash")
+		for _, name := range orphans {
+			if _, err := os.Stat(filepath.Join(tmpDir, name)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected orphaned %s to be removed, got %v", name, err)
+			}
+		}
+		if err := db.Put("k4", "value-k4"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		manifestPath := filepath.Join(tmpDir, manifestName)
+		manifest, err := os.ReadFile(manifestPath)
+		if err != nil {
+			t.Fatalf("failed to read manifest: %v", err)
+		}
+		manifest[len(manifest)-1] ^= 0xff
+		if err := os.WriteFile(manifestPath, manifest, 0644); err != nil {
+			t.Fatalf("failed to corrupt manifest: %v", err)
+		}
+		if _, err := Open(tmpDir, 60); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("expected ErrCorrupted for a damaged manifest, got %v", err)
+		}
+	})
+
+	t.Run("Original format", func(t *testing.T) {
+		// Segments as written before there were manifests: size, key length,
+		// key, value length and value, and nothing else.
+		legacyRecord := func(key, value string) []byte {
+			res := make([]byte, 12+len(key)+len(value))
+			binary.LittleEndian.PutUint32(res, uint32(len(res)))
+			binary.LittleEndian.PutUint32(res[4:], uint32(len(key)))
+			copy(res[8:], key)
+			binary.LittleEndian.PutUint32(res[8+len(key):], uint32(len(value)))
+			copy(res[12+len(key):], value)
+			return res
+		}
+		long := strings.Repeat("long value ", 10)
+		segments := [][]byte{
+			append(legacyRecord("k1", "old"), legacyRecord("k2", "v2")...),
+			append(legacyRecord("k1", "v1"), legacyRecord("k3", long)...),
+			// A record cut short by a crash at the end of the last segment.
+			append(legacyRecord("k4", long), legacyRecord("k5", "torn")[:10]...),
+		}
+		expected := map[string]string{"k1": "v1", "k2": "v2", "k3": long, "k4": long}
+
+		for _, diskIndex := range []bool{false, true} {
+			tmpDir := filepath.Join(baseTmpDir, fmt.Sprintf("original_format_%t", diskIndex))
+			if err := os.MkdirAll(filepath.Join(tmpDir, convertDirName), 0755); err != nil {
+				t.Fatalf("failed to create dir: %v", err)
+			}
+			for i, data := range segments {
+				if err := os.WriteFile(filepath.Join(tmpDir, segmentName(i+1)), data, 0644); err != nil {
+					t.Fatalf("failed to write segment: %v", err)
+				}
+			}
+			// A conversion that crashed before writing its manifest.
+			if err := os.WriteFile(filepath.Join(tmpDir, convertDirName, segmentName(4)), []byte("partial"), 0644); err != nil {
+				t.Fatalf("failed to write partial conversion: %v", err)
+			}
+
+			opts := Options{MaxSegmentSize: 100, DiskIndex: diskIndex}
+			if _, err := OpenWithOptions(tmpDir, Options{MaxSegmentSize: 100, ReadOnly: true}); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("disk index %t: expected a read-only open to refuse the original format, got %v", diskIndex, err)
+			}
+			db, err := OpenWithOptions(tmpDir, opts)
+			if err != nil {
+				t.Fatalf("disk index %t: failed to open the original format: %v", diskIndex, err)
+			}
+			check := func(db *Db, stage string) {
+				for key, want := range expected {
+					if got, err := db.Get(key); err != nil || got != want {
+						t.Errorf("disk index %t, %s: unexpected value for key=%s: %q, %v", diskIndex, stage, key, got, err)
+					}
+				}
+				if _, err := db.Get("k5"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("disk index %t, %s: expected the torn record to be dropped, got %v", diskIndex, stage, err)
+				}
+			}
+			check(db, "converted")
+			if _, version, err := db.GetVersioned("k1"); err != nil || version != 2 {
+				t.Errorf("disk index %t: expected version 2 for a key written twice, got %d, %v", diskIndex, version, err)
+			}
+			if err := db.Put("k6", "new"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close db: %v", err)
+			}
+
+			for i := range segments {
+				if _, err := os.Stat(filepath.Join(tmpDir, segmentName(i+1))); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("disk index %t: expected segment %d of the original format to be removed, got %v", diskIndex, i+1, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(tmpDir, convertDirName)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("disk index %t: expected the conversion directory to be removed, got %v", diskIndex, err)
+			}
+
+			db, err = OpenWithOptions(tmpDir, opts)
+			if err != nil {
+				t.Fatalf("disk index %t: failed to reopen db: %v", diskIndex, err)
+			}
+			check(db, "reopened")
+			if got, err := db.Get("k6"); err != nil || got != "new" {
+				t.Errorf("disk index %t: unexpected value for key=k6: %q, %v", diskIndex, got, err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close db: %v", err)
+			}
+		}
+
+		// A manifest without a format version comes from a development
+		// version whose records cannot be told apart.
+		tmpDir := filepath.Join(baseTmpDir, "original_format_manifest")
+		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		unversioned := make([]byte, 12)
+		binary.LittleEndian.PutUint32(unversioned, 1)
+		binary.LittleEndian.PutUint32(unversioned[8:], 1)
+		binary.LittleEndian.PutUint32(unversioned[4:], crc32.ChecksumIEEE(unversioned[8:]))
+		if err := os.WriteFile(filepath.Join(tmpDir, manifestName), unversioned, 0644); err != nil {
+			t.Fatalf("failed to write manifest: %v", err)
+		}
+		if _, err := Open(tmpDir, 100); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("expected ErrUnsupportedFormat for a manifest without a format version, got %v", err)
+		}
+	})
+
+	t.Run("Disk index", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "disk_index")
+		db, err := Open(tmpDir, 512, WithDiskIndex())
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+
+		expected := map[string]string{}
+		for i := 0; i < 200; i++ {
+			key, value := fmt.Sprintf("key%03d", i%80), fmt.Sprintf("value%d", i)
+			if err := db.Put(key, value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			expected[key] = value
+		}
+		for i := 0; i < 80; i += 7 {
+			key := fmt.Sprintf("key%03d", i)
+			if err := db.Delete(key); err != nil {
+				t.Fatalf("Delete(%s) failed: %v", key, err)
+			}
+			delete(expected, key)
+		}
+		if err := db.Delete("key000"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound deleting a deleted key, got %v", err)
+		}
+		if err := db.PutWithTTL("key001", "short-lived", time.Millisecond); err != nil {
+			t.Fatalf("PutWithTTL failed: %v", err)
+		}
+		delete(expected, "key001")
+		if err := db.PutIfVersion("key002", "updated", 999); !errors.Is(err, ErrConflict) {
+			t.Errorf("expected ErrConflict for a stale version, got %v", err)
+		}
+		_, version, err := db.GetVersioned("key002")
+		if err != nil || version < 2 {
+			t.Errorf("GetVersioned(key002) = %d, %v", version, err)
+		}
+		if err := db.PutIfVersion("key002", "updated", version); err != nil {
+			t.Errorf("PutIfVersion failed: %v", err)
+		}
+		expected["key002"] = "updated"
+		time.Sleep(2 * time.Millisecond)
+
+		db.mu.Lock()
+		inMemory, sealed := db.index.len(), len(db.segments)-1
+		db.mu.Unlock()
+		if sealed < 3 || inMemory >= len(expected) {
+			t.Errorf("expected most keys on disk, %d of %d in memory with %d sealed segments", inMemory, len(expected), sealed)
+		}
+
+		check := func(db *Db, stage string) {
+			t.Helper()
+			for key, want := range expected {
+				if got, err := db.Get(key); err != nil || got != want {
+					t.Errorf("%s: unexpected value for key=%s: %q, %v", stage, key, got, err)
+				}
+			}
+			for _, key := range []string{"key000", "key001", "key007", "missing"} {
+				if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s: expected ErrNotFound for key=%s, got %v", stage, key, err)
+				}
+			}
+			it := db.Scan("", "", 0)
+			var scanned int
+			for it.Next() {
+				if expected[it.Key()] != it.Value() {
+					t.Errorf("%s: scan returned %s=%q", stage, it.Key(), it.Value())
+				}
+				scanned++
+			}
+			if it.Err() != nil || scanned != len(expected) {
+				t.Errorf("%s: scan returned %d of %d keys: %v", stage, scanned, len(expected), it.Err())
+			}
+		}
+		garbage := func(db *Db) (int64, int64) {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			return db.sealedGarbage()
+		}
+		check(db, "after writes")
+		diskGarbage, _ := garbage(db)
+
+		snap := db.Snapshot()
+		if err := db.Put("key003", "after snapshot"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if got, err := snap.Get("key003"); err != nil || got != expected["key003"] {
+			t.Errorf("snapshot sees a later write: %q, %v", got, err)
+		}
+		snap.Release()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		expected["key003"] = "after snapshot"
+
+		// Opening without the option rebuilds the index in memory, which must
+		// agree with the disk index on how much garbage there is.
+		db, err = Open(tmpDir, 512)
+		if err != nil {
+			t.Fatalf("failed to reopen db in memory: %v", err)
+		}
+		check(db, "in memory")
+		memGarbage, _ := garbage(db)
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		keyFiles, _ := filepath.Glob(filepath.Join(tmpDir, "*"+keysSuffix))
+		if len(keyFiles) == 0 {
+			t.Fatal("expected sealed segments to have key files")
+		}
+		if err := os.Remove(keyFiles[0]); err != nil {
+			t.Fatalf("failed to remove key file: %v", err)
+		}
+		db, err = Open(tmpDir, 512, WithDiskIndex())
+		if err != nil {
+			t.Fatalf("failed to reopen db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		check(db, "after reopen")
+		if _, err := os.Stat(keyFiles[0]); err != nil {
+			t.Errorf("expected the missing key file to be rebuilt: %v", err)
+		}
+		if reopened, _ := garbage(db); reopened != memGarbage || diskGarbage == 0 {
+			t.Errorf("garbage = %d after reopen and %d before, in memory %d", reopened, diskGarbage, memGarbage)
+		}
+
+		db.Compact()
+		db.compactionWg.Wait()
+		check(db, "after compaction")
+		if g, total := garbage(db); g != 0 || total == 0 {
+			t.Errorf("expected no garbage after compaction, got %d of %d bytes", g, total)
+		}
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		tmpDir := filepath.Join(baseTmpDir, "options")
+		for _, opts := range []Options{
+			{},
+			{MaxSegmentSize: 100, GetWorkers: -1},
+			{MaxSegmentSize: 100, QueueDepth: -1},
+			{MaxSegmentSize: 100, SyncPolicy: SyncInterval},
+		} {
+			if _, err := OpenWithOptions(tmpDir, opts); err == nil {
+				t.Errorf("expected OpenWithOptions to reject %+v", opts)
+			}
+		}
+
+		var logs bytes.Buffer
+		db, err := OpenWithOptions(tmpDir, Options{
+			MaxSegmentSize: 100,
+			GetWorkers:     1,
+			QueueDepth:     1,
+			Logger:         log.New(&logs, "", 0),
+		})
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		db.Compact()
+		db.compactionWg.Wait()
+		if !strings.Contains(logs.String(), "compaction completed successfully") {
+			t.Errorf("expected compaction to be logged to the configured logger, got %q", logs.String())
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+
+		// Leave a torn write behind, which a read-only open must not cut off.
+		last := filepath.Join(tmpDir, segmentName(db.segments[len(db.segments)-1].num))
+		f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("failed to open segment: %v", err)
+		}
+		if _, err := f.Write([]byte{0xff, 0x00}); err != nil {
+			t.Fatalf("failed to write torn record: %v", err)
+		}
+		f.Close()
+		listDir := func() string {
+			var listing []string
+			files, _ := os.ReadDir(tmpDir)
+			for _, f := range files {
+				info, _ := f.Info()
+				listing = append(listing, fmt.Sprintf("%s:%d", f.Name(), info.Size()))
+			}
+			return strings.Join(listing, " ")
+		}
+		before := listDir()
+
+		db, err = Open(tmpDir, 100, WithReadOnly(), WithLogger(log.New(io.Discard, "", 0)))
+		if err != nil {
+			t.Fatalf("failed to open db read-only: %v", err)
+		}
+		if got, err := db.Get("key3"); err != nil || got != "value" {
+			t.Errorf("unexpected value for key3: %q, %v", got, err)
+		}
+		if err := db.Put("key3", "changed"); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("expected ErrReadOnly for Put, got %v", err)
+		}
+		if err := db.Delete("key3"); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("expected ErrReadOnly for Delete, got %v", err)
+		}
+		db.Compact()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close db: %v", err)
+		}
+		if after := listDir(); after != before {
+			t.Errorf("read-only open changed the directory:\n%s\n%s", before, after)
+		}
+
+		if _, err := Open(filepath.Join(baseTmpDir, "options_missing"), 100, WithReadOnly()); err == nil {
+			t.Error("expected a read-only open of a missing database to fail")
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		for _, diskIndex := range []bool{false, true} {
+			tmpDir := filepath.Join(baseTmpDir, fmt.Sprintf("stats_%t", diskIndex))
+			db, err := OpenWithOptions(tmpDir, Options{MaxSegmentSize: 150, GetWorkers: 2, DiskIndex: diskIndex})
+			if err != nil {
+				t.Fatalf("failed to open db: %v", err)
+			}
+
+			for i := 0; i < 10; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			if err := db.Put("key0", "changed"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if err := db.Delete("key1"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			var batch WriteBatch
+			batch.Put("key2", "batched")
+			batch.Delete("key3")
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if _, err := db.Increment("counter", 1); err != nil {
+				t.Fatalf("Increment failed: %v", err)
+			}
+			if err := db.PutIfVersion("key4", "stale", 7); !errors.Is(err, ErrConflict) {
+				t.Fatalf("expected ErrConflict, got %v", err)
+			}
+			if _, err := db.Get("key5"); err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			it := db.ScanPrefix("key")
+			for it.Next() {
+			}
+			it.Close()
+
+			stats, err := db.Stats()
+			if err != nil {
+				t.Fatalf("Stats failed: %v", err)
+			}
+			if stats.Keys != 9 {
+				t.Errorf("disk index %t: expected 9 keys, got %d", diskIndex, stats.Keys)
+			}
+			want := OpStats{Gets: 1, Scans: 1, Puts: 11, Deletes: 1, Batches: 1, Increments: 1, FailedWrites: 1}
+			if stats.Ops != want {
+				t.Errorf("disk index %t: ops = %+v, want %+v", diskIndex, stats.Ops, want)
+			}
+			if stats.SegmentCount < 2 || stats.SegmentCount != len(stats.Segments) || !stats.Segments[stats.SegmentCount-1].Active {
+				t.Errorf("disk index %t: unexpected segments %+v", diskIndex, stats.Segments)
+			}
+			var size int64
+			for _, seg := range stats.Segments {
+				size += seg.Size
+			}
+			if total, _ := db.Size(); size != total || stats.LiveBytes+stats.GarbageBytes != total {
+				t.Errorf("disk index %t: %d live and %d garbage bytes do not add up to %d", diskIndex, stats.LiveBytes, stats.GarbageBytes, total)
+			}
+			if stats.GarbageBytes == 0 {
+				t.Errorf("disk index %t: expected overwritten and deleted records to be garbage", diskIndex)
+			}
+			if stats.GetWorkers != 2 || stats.BusyGetWorkers != 0 || stats.PendingWrites != 0 {
+				t.Errorf("disk index %t: unexpected workload %+v", diskIndex, stats)
+			}
+			if !stats.Compaction.LastStarted.IsZero() {
+				t.Errorf("disk index %t: expected no compaction yet, got %+v", diskIndex, stats.Compaction)
+			}
+
+			db.Compact()
+			db.compactionWg.Wait()
+			compacted, err := db.Stats()
+			if err != nil {
+				t.Fatalf("Stats failed: %v", err)
+			}
+			c := compacted.Compaction
+			if c.Running || c.LastStarted.IsZero() || c.LastDuration <= 0 || c.LastError != "" {
+				t.Errorf("disk index %t: unexpected compaction stats %+v", diskIndex, c)
+			}
+			if compacted.Keys != 9 || compacted.GarbageBytes >= stats.GarbageBytes {
+				t.Errorf("disk index %t: expected compaction to keep 9 keys and drop garbage, got %d keys and %d garbage bytes", diskIndex, compacted.Keys, compacted.GarbageBytes)
+			}
+
+			// An expired key is counted until a compaction drops it.
+			if err := db.PutWithTTL("short", "lived", time.Millisecond); err != nil {
+				t.Fatalf("PutWithTTL failed: %v", err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := db.Put(fmt.Sprintf("filler%d", i), "value"); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			if expired, err := db.Stats(); err != nil || expired.Keys != 20 {
+				t.Errorf("disk index %t: expected 20 keys with the expired one, got %d, %v", diskIndex, expired.Keys, err)
+			}
+			db.Compact()
+			db.compactionWg.Wait()
+			if dropped, err := db.Stats(); err != nil || dropped.Keys != 19 {
+				t.Errorf("disk index %t: expected 19 keys once compacted, got %d, %v", diskIndex, dropped.Keys, err)
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close db: %v", err)
+			}
+		}
+	})
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		for _, diskIndex := range []bool{false, true} {
+			tmpDir := filepath.Join(baseTmpDir, fmt.Sprintf("checkpoint_%t", diskIndex))
+			backupDir := filepath.Join(baseTmpDir, fmt.Sprintf("checkpoint_%t_backup", diskIndex))
+			opts := Options{MaxSegmentSize: 150, DiskIndex: diskIndex}
+			db, err := OpenWithOptions(tmpDir, opts)
+			if err != nil {
+				t.Fatalf("failed to open db: %v", err)
+			}
+
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			if err := db.Delete("key3"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if err := db.Checkpoint(backupDir); err != nil {
+				t.Fatalf("Checkpoint failed: %v", err)
+			}
+			sealed := db.segments[0].file.Name()
+			original, err := os.Stat(sealed)
+			if err != nil {
+				t.Fatalf("failed to stat sealed segment: %v", err)
+			}
+			if linked, err := os.Stat(filepath.Join(backupDir, filepath.Base(sealed))); err != nil || !os.SameFile(original, linked) {
+				t.Errorf("disk index %t: expected the sealed segment to be hard-linked, got %v", diskIndex, err)
+			}
+
+			// Nothing done after the checkpoint shows up in it.
+			if err := db.Put("key0", "changed"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if err := db.Put("late", "write"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			db.Compact()
+			db.compactionWg.Wait()
+			if err := db.Checkpoint(backupDir); err == nil {
+				t.Errorf("disk index %t: expected a checkpoint into a non-empty directory to fail", diskIndex)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close db: %v", err)
+			}
+
+			backup, err := OpenWithOptions(backupDir, opts)
+			if err != nil {
+				t.Fatalf("failed to open checkpoint: %v", err)
+			}
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("key%d", i)
+				got, err := backup.Get(key)
+				if i == 3 {
+					if !errors.Is(err, ErrNotFound) {
+						t.Errorf("disk index %t: expected deleted key to stay deleted, got %q, %v", diskIndex, got, err)
+					}
+					continue
+				}
+				if want := fmt.Sprintf("value%d", i); err != nil || got != want {
+					t.Errorf("disk index %t: unexpected value for %s: %q, %v", diskIndex, key, got, err)
+				}
+			}
+			if _, err := backup.Get("late"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("disk index %t: expected a write made after the checkpoint to be missing, got %v", diskIndex, err)
+			}
+			if err := backup.Close(); err != nil {
+				t.Fatalf("failed to close checkpoint: %v", err)
+			}
+		}
+	})
+
+	t.Run("Export and import", func(t *testing.T) {
+		src, err := Open(filepath.Join(baseTmpDir, "export_src"), 4096)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = src.Close()
+		})
+		dst, err := Open(filepath.Join(baseTmpDir, "export_dst"), 4096)
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = dst.Close()
+		})
+
+		const keys = 2500
+		var batch WriteBatch
+		for i := 0; i < keys; i++ {
+			batch.Put(fmt.Sprintf("key%05d", i), fmt.Sprintf("value %d with \"quotes\" and <tags>", i))
+		}
+		if err := src.Write(&batch); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := src.Delete("key00007"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if err := src.Put("binary", "\xff\x00\xfe"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := src.PutInt64("counter", -42); err != nil {
+			t.Fatalf("PutInt64 failed: %v", err)
+		}
+		if err := src.PutWithTTL("session", "s", time.Hour); err != nil {
+			t.Fatalf("PutWithTTL failed: %v", err)
+		}
+		if err := src.PutWithTTL("gone", "g", time.Millisecond); err != nil {
+			t.Fatalf("PutWithTTL failed: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		var buf bytes.Buffer
+		exported, err := src.Export(&buf)
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		if want := keys - 1 + 3; exported != want || strings.Count(buf.String(), "\n") != want {
+			t.Fatalf("expected %d exported keys, got %d and %d lines", want, exported, strings.Count(buf.String(), "\n"))
+		}
+
+		imported, err := dst.Import(&buf)
+		if err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if imported != exported {
+			t.Errorf("expected %d imported keys, got %d", exported, imported)
+		}
+		want, got := src.ScanPrefix(""), dst.ScanPrefix("")
+		for want.Next() {
+			if !got.Next() || got.Key() != want.Key() || got.Value() != want.Value() {
+				t.Fatalf("imported data differs at key %s: got %q=%q", want.Key(), got.Key(), got.Value())
+			}
+		}
+		if got.Next() {
+			t.Errorf("unexpected extra imported key %s", got.Key())
+		}
+		if err := errors.Join(want.Err(), got.Err()); err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		if n, err := dst.Increment("counter", 1); err != nil || n != -41 {
+			t.Errorf("expected imported counter to increment to -41, got %d, %v", n, err)
+		}
+
+		for _, input := range []string{
+			`{"key":"a","value":"1"}` + "\n" + `{"key":"b"}`,
+			`{"key":"a","value":"1","extra":true}`,
+			`{"value":"1"}`,
+			`not json`,
+		} {
+			if _, err := dst.Import(strings.NewReader(input)); !errors.Is(err, ErrInvalidImport) {
+				t.Errorf("expected ErrInvalidImport for %q, got %v", input, err)
+			}
+		}
+	})
+
 	t.Run("Concurrency", func(t *testing.T) {
 		tmpDir := filepath.Join(baseTmpDir, "concurrency")
 		db, err := Open(tmpDir, 1024)
@@ -303,3 +2359,82 @@ func TestDb(t *testing.T) {
 		}
 	})
 }
+
+func BenchmarkPut(b *testing.B) {
+	value := strings.Repeat("v", 100)
+	for _, policy := range []SyncPolicy{SyncNever, SyncAlways} {
+		b.Run(policy.String()+"/sequential", func(b *testing.B) {
+			db, err := Open(b.TempDir(), 64*1024*1024, WithSyncPolicy(policy, 0))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		// Concurrent writers share writes and fsyncs through group commit.
+		b.Run(policy.String()+"/parallel", func(b *testing.B) {
+			db, err := Open(b.TempDir(), 64*1024*1024, WithSyncPolicy(policy, 0))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			var counter atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := db.Put(fmt.Sprintf("key%d", counter.Add(1)), value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	const keys = 1000
+	for _, bench := range []struct {
+		size  int
+		cache int64
+	}{{100, 0}, {10 * 1024, 0}, {100, 1 << 20}, {10 * 1024, 16 << 20}} {
+		size := bench.size
+		b.Run(fmt.Sprintf("value=%d/cache=%d", size, bench.cache), func(b *testing.B) {
+			// Small segments spread the keys over sealed segments as well as
+			// the active one.
+			db, err := Open(b.TempDir(), 256*1024, WithCache(bench.cache))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			value := strings.Repeat("v", size)
+			for i := 0; i < keys; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,721 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"time"
+)
+
+// WithDiskIndex keeps only the keys of the active segment in memory. Every
+// sealed segment gets a key file sorted by key, of which only the first key
+// of each block stays in memory, so lookups of older keys read one block per
+// segment searched. Deletes are kept in memory as tombstones until the
+// segment is sealed, since they have to hide records in older segments.
+//
+// Segments sealed under the disk index do not always get hint files, so
+// opening the database without the option may have to scan them in full.
+func WithDiskIndex() Option {
+	return func(o *Options) {
+		o.DiskIndex = true
+	}
+}
+
+const (
+	keysSuffix = ".keys"
+	// keyBlockSize is the size a block grows to before the next one starts.
+	keyBlockSize = 4096
+)
+
+func keysPath(segmentPath string) string {
+	return segmentPath + keysSuffix
+}
+
+// Key file layout:
+//
+// (blocks...) (directory) (footer)
+//
+// A block holds the entries of consecutive keys:
+//
+// 0       4                 <-- offset
+// (count) (entries...)
+//
+// 0        8      16     17        25        33   37       <-- offset
+// (offset) (size) (kind) (expires) (version) (kl) (key)
+//
+// The directory lists the blocks and ends with the last key of the file:
+//
+// 0       4                 <-- offset
+// (count) (blocks...) (kl) (last key)
+//
+// 0        8        12    16   20           <-- offset
+// (offset) (length) (crc) (kl) (first key)
+//
+// The footer locates the directory:
+//
+// 0              8                  16                 20    <-- offset
+// (segment size) (directory offset) (directory length) (crc)
+//
+// The crc of a block is in its directory entry and the crc of the directory
+// in the footer; both cover the bytes as stored. Key files hold keys, so
+// blocks and the directory are encrypted one by one when the segments are.
+
+const (
+	keyEntrySize   = 37
+	keyBlockHeader = 20
+	keyFooterSize  = 24
+)
+
+type keyBlock struct {
+	firstKey string
+	offset   int64
+	length   int
+	crc      uint32
+}
+
+// keyFile is the key index of a sealed segment. It is immutable and read
+// with positional reads, so any number of lookups can share it.
+type keyFile struct {
+	file       *os.File
+	segmentNum int
+	blocks     []keyBlock
+	lastKey    string
+	ring       *keyring
+}
+
+// keyFileWriter writes a key file from keys added in ascending order. It
+// writes to a temporary file that finish renames into place.
+type keyFileWriter struct {
+	file    *os.File
+	path    string
+	writer  *bufio.Writer
+	ring    *keyring
+	offset  int64
+	block   []byte
+	count   int
+	first   string
+	lastKey string
+	blocks  []keyBlock
+}
+
+func createKeyFile(segmentPath string, ring *keyring) (*keyFileWriter, error) {
+	path := keysPath(segmentPath)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &keyFileWriter{file: f, path: path, writer: bufio.NewWriter(f), ring: ring}, nil
+}
+
+func (w *keyFileWriter) add(key string, pos SegmentPos) error {
+	if w.count == 0 {
+		w.block = append(w.block[:0], 0, 0, 0, 0)
+		w.first = key
+	}
+	var e [keyEntrySize]byte
+	binary.LittleEndian.PutUint64(e[0:], uint64(pos.offset))
+	binary.LittleEndian.PutUint64(e[8:], uint64(pos.size))
+	e[16] = kindValue
+	if pos.deleted {
+		e[16] = kindTombstone
+	}
+	binary.LittleEndian.PutUint64(e[17:], uint64(pos.expiresAt))
+	binary.LittleEndian.PutUint64(e[25:], pos.version)
+	binary.LittleEndian.PutUint32(e[33:], uint32(len(key)))
+	w.block = append(w.block, e[:]...)
+	w.block = append(w.block, key...)
+	w.count++
+	w.lastKey = key
+	if len(w.block) >= keyBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *keyFileWriter) flushBlock() error {
+	if w.count == 0 {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(w.block, uint32(w.count))
+	data := w.seal(w.block)
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	w.blocks = append(w.blocks, keyBlock{firstKey: w.first, offset: w.offset, length: len(data), crc: crc32.ChecksumIEEE(data)})
+	w.offset += int64(len(data))
+	w.count = 0
+	return nil
+}
+
+func (w *keyFileWriter) seal(data []byte) []byte {
+	if w.ring == nil {
+		return data
+	}
+	return w.ring.seal(data, nil)
+}
+
+// finish writes the directory and the footer and moves the file into place.
+// The file is synced first, so a key file that exists is always complete.
+func (w *keyFileWriter) finish(segmentSize int64) error {
+	if err := w.flushBlock(); err != nil {
+		w.abort()
+		return err
+	}
+
+	size := 4 + 4 + len(w.lastKey)
+	for _, b := range w.blocks {
+		size += keyBlockHeader + len(b.firstKey)
+	}
+	dir := make([]byte, 4, size)
+	binary.LittleEndian.PutUint32(dir, uint32(len(w.blocks)))
+	for _, b := range w.blocks {
+		var h [keyBlockHeader]byte
+		binary.LittleEndian.PutUint64(h[0:], uint64(b.offset))
+		binary.LittleEndian.PutUint32(h[8:], uint32(b.length))
+		binary.LittleEndian.PutUint32(h[12:], b.crc)
+		binary.LittleEndian.PutUint32(h[16:], uint32(len(b.firstKey)))
+		dir = append(dir, h[:]...)
+		dir = append(dir, b.firstKey...)
+	}
+	dir = binary.LittleEndian.AppendUint32(dir, uint32(len(w.lastKey)))
+	dir = append(dir, w.lastKey...)
+	dir = w.seal(dir)
+
+	var footer [keyFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], uint64(segmentSize))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(w.offset))
+	binary.LittleEndian.PutUint32(footer[16:], uint32(len(dir)))
+	binary.LittleEndian.PutUint32(footer[20:], crc32.ChecksumIEEE(dir))
+
+	err := func() error {
+		if _, err := w.writer.Write(dir); err != nil {
+			return err
+		}
+		if _, err := w.writer.Write(footer[:]); err != nil {
+			return err
+		}
+		if err := w.writer.Flush(); err != nil {
+			return err
+		}
+		return w.file.Sync()
+	}()
+	if err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *keyFileWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// writeKeyFile writes the key file of a segment from a cursor over its keys
+// and opens it.
+func writeKeyFile(seg *Segment, cur keyCursor, ring *keyring) (*keyFile, error) {
+	w, err := createKeyFile(seg.file.Name(), ring)
+	if err != nil {
+		return nil, err
+	}
+	for n, ok := cur.next(); ok; n, ok = cur.next() {
+		if err := w.add(n.key, n.pos); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	if err := cur.err(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.finish(seg.offset); err != nil {
+		return nil, err
+	}
+	return openKeyFile(seg.file.Name(), seg.num, seg.offset, ring)
+}
+
+// openKeyFile reads the directory of a segment's key file. Like a hint file, a
+// key file made for a different size of the segment is rejected as stale.
+func openKeyFile(segmentPath string, segmentNum int, segmentSize int64, ring *keyring) (*keyFile, error) {
+	f, err := os.Open(keysPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	k, err := readKeyDirectory(f, segmentSize, ring)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	k.segmentNum = segmentNum
+	return k, nil
+}
+
+func readKeyDirectory(f *os.File, segmentSize int64, ring *keyring) (*keyFile, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < keyFooterSize {
+		return nil, fmt.Errorf("%w: key file too short", ErrCorrupted)
+	}
+	var footer [keyFooterSize]byte
+	if _, err := f.ReadAt(footer[:], stat.Size()-keyFooterSize); err != nil {
+		return nil, err
+	}
+	if got := int64(binary.LittleEndian.Uint64(footer[0:])); got != segmentSize {
+		return nil, fmt.Errorf("stale key file: made for %d bytes of segment, segment has %d", got, segmentSize)
+	}
+	dirOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	dirLength := int64(binary.LittleEndian.Uint32(footer[16:]))
+	if dirOffset+dirLength+keyFooterSize != stat.Size() {
+		return nil, fmt.Errorf("%w: key file directory out of bounds", ErrCorrupted)
+	}
+	dir := make([]byte, dirLength)
+	if _, err := f.ReadAt(dir, dirOffset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(dir) != binary.LittleEndian.Uint32(footer[20:]) {
+		return nil, fmt.Errorf("%w: key file directory checksum mismatch", ErrCorrupted)
+	}
+	if ring != nil {
+		if dir, err = ring.open(dir, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	k := &keyFile{file: f, ring: ring}
+	if len(dir) < 4 {
+		return nil, fmt.Errorf("%w: key file directory too short", ErrCorrupted)
+	}
+	count := int(binary.LittleEndian.Uint32(dir))
+	pos := 4
+	for i := 0; i < count; i++ {
+		if pos+keyBlockHeader > len(dir) {
+			return nil, fmt.Errorf("%w: truncated key file directory", ErrCorrupted)
+		}
+		kl := int(binary.LittleEndian.Uint32(dir[pos+16:]))
+		if pos+keyBlockHeader+kl > len(dir) {
+			return nil, fmt.Errorf("%w: truncated key file directory", ErrCorrupted)
+		}
+		b := keyBlock{
+			firstKey: string(dir[pos+keyBlockHeader : pos+keyBlockHeader+kl]),
+			offset:   int64(binary.LittleEndian.Uint64(dir[pos:])),
+			length:   int(binary.LittleEndian.Uint32(dir[pos+8:])),
+			crc:      binary.LittleEndian.Uint32(dir[pos+12:]),
+		}
+		if b.offset+int64(b.length) > dirOffset {
+			return nil, fmt.Errorf("%w: key file block out of bounds", ErrCorrupted)
+		}
+		k.blocks = append(k.blocks, b)
+		pos += keyBlockHeader + kl
+	}
+	if pos+4 > len(dir) || pos+4+int(binary.LittleEndian.Uint32(dir[pos:])) != len(dir) {
+		return nil, fmt.Errorf("%w: invalid last key in key file directory", ErrCorrupted)
+	}
+	k.lastKey = string(dir[pos+4:])
+	return k, nil
+}
+
+func (k *keyFile) close() error {
+	return k.file.Close()
+}
+
+// readBlock returns the entries of a block in key order.
+func (k *keyFile) readBlock(i int) ([]indexNode, error) {
+	b := k.blocks[i]
+	data := make([]byte, b.length)
+	if _, err := k.file.ReadAt(data, b.offset); err != nil {
+		return nil, fmt.Errorf("failed to read key block %d of segment %d: %w", i, k.segmentNum, err)
+	}
+	if crc32.ChecksumIEEE(data) != b.crc {
+		return nil, fmt.Errorf("%w: checksum mismatch in key block %d of segment %d", ErrCorrupted, i, k.segmentNum)
+	}
+	if k.ring != nil {
+		var err error
+		if data, err = k.ring.open(data, nil); err != nil {
+			return nil, fmt.Errorf("failed to decrypt key block %d of segment %d: %w", i, k.segmentNum, err)
+		}
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: key block %d of segment %d too short", ErrCorrupted, i, k.segmentNum)
+	}
+
+	count := int(binary.LittleEndian.Uint32(data))
+	entries := make([]indexNode, 0, count)
+	pos := 4
+	for j := 0; j < count; j++ {
+		if pos+keyEntrySize > len(data) {
+			return nil, fmt.Errorf("%w: truncated entry in key block %d of segment %d", ErrCorrupted, i, k.segmentNum)
+		}
+		kl := int(binary.LittleEndian.Uint32(data[pos+33:]))
+		if pos+keyEntrySize+kl > len(data) {
+			return nil, fmt.Errorf("%w: truncated key in key block %d of segment %d", ErrCorrupted, i, k.segmentNum)
+		}
+		entries = append(entries, indexNode{
+			key: string(data[pos+keyEntrySize : pos+keyEntrySize+kl]),
+			pos: SegmentPos{
+				segmentNum: k.segmentNum,
+				offset:     int64(binary.LittleEndian.Uint64(data[pos:])),
+				size:       int64(binary.LittleEndian.Uint64(data[pos+8:])),
+				deleted:    data[pos+16] == kindTombstone,
+				expiresAt:  int64(binary.LittleEndian.Uint64(data[pos+17:])),
+				version:    binary.LittleEndian.Uint64(data[pos+25:]),
+			},
+		})
+		pos += keyEntrySize + kl
+	}
+	return entries, nil
+}
+
+// blockFor returns the block that would hold the key: the last one whose
+// first key is not greater than it.
+func (k *keyFile) blockFor(key string) int {
+	return sort.Search(len(k.blocks), func(i int) bool {
+		return k.blocks[i].firstKey > key
+	}) - 1
+}
+
+// find returns the position of the key's record in the segment. Tombstones
+// are found too; they are marked as deleted.
+func (k *keyFile) find(key string) (SegmentPos, bool, error) {
+	if len(k.blocks) == 0 || key < k.blocks[0].firstKey || key > k.lastKey {
+		return SegmentPos{}, false, nil
+	}
+	entries, err := k.readBlock(k.blockFor(key))
+	if err != nil {
+		return SegmentPos{}, false, err
+	}
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key >= key
+	})
+	if i < len(entries) && entries[i].key == key {
+		return entries[i].pos, true, nil
+	}
+	return SegmentPos{}, false, nil
+}
+
+// keyCursor walks keys in order together with the positions of their records.
+type keyCursor interface {
+	next() (*indexNode, bool)
+	// err returns the error that ended the walk early, if any.
+	err() error
+}
+
+func (cur *indexCursor) err() error {
+	return nil
+}
+
+// keyFileCursor walks a key file one block at a time.
+type keyFileCursor struct {
+	k       *keyFile
+	block   int
+	start   string
+	entries []indexNode
+	i       int
+	failure error
+}
+
+func (k *keyFile) seek(start string) *keyFileCursor {
+	return &keyFileCursor{k: k, block: max(k.blockFor(start), 0), start: start}
+}
+
+func (cur *keyFileCursor) next() (*indexNode, bool) {
+	for cur.failure == nil {
+		if cur.entries == nil {
+			if cur.block >= len(cur.k.blocks) {
+				return nil, false
+			}
+			if cur.entries, cur.failure = cur.k.readBlock(cur.block); cur.failure != nil {
+				break
+			}
+			cur.i = sort.Search(len(cur.entries), func(i int) bool {
+				return cur.entries[i].key >= cur.start
+			})
+		}
+		if cur.i < len(cur.entries) {
+			cur.i++
+			return &cur.entries[cur.i-1], true
+		}
+		cur.entries = nil
+		cur.block++
+	}
+	return nil, false
+}
+
+func (cur *keyFileCursor) err() error {
+	return cur.failure
+}
+
+// mergeCursor walks several cursors at once and yields every key once, with
+// the position from the first cursor that has it. Sources are ordered newest
+// first, so that is the key's latest record, which may be a tombstone.
+type mergeCursor struct {
+	sources []keyCursor
+	heads   []*indexNode
+	failure error
+}
+
+func newMergeCursor(sources []keyCursor) *mergeCursor {
+	m := &mergeCursor{sources: sources, heads: make([]*indexNode, len(sources))}
+	for i := range sources {
+		m.advance(i)
+	}
+	return m
+}
+
+func (m *mergeCursor) advance(i int) {
+	n, ok := m.sources[i].next()
+	if !ok {
+		n = nil
+		if err := m.sources[i].err(); err != nil && m.failure == nil {
+			m.failure = err
+		}
+	}
+	m.heads[i] = n
+}
+
+func (m *mergeCursor) next() (*indexNode, bool) {
+	if m.failure != nil {
+		return nil, false
+	}
+	var best *indexNode
+	for _, h := range m.heads {
+		if h != nil && (best == nil || h.key < best.key) {
+			best = h
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	key := best.key
+	for i, h := range m.heads {
+		if h != nil && h.key == key {
+			m.advance(i)
+		}
+	}
+	if m.failure != nil {
+		return nil, false
+	}
+	return best, true
+}
+
+func (m *mergeCursor) err() error {
+	return m.failure
+}
+
+// keyTable is a frozen view of where the latest record of every key is: the
+// in-memory index and, with the disk index, the key files of sealed segments.
+type keyTable struct {
+	index keyIndex
+	// files are ordered from the oldest segment to the newest.
+	files []*keyFile
+}
+
+// keyTable returns the current view. Must be called with db.mu held.
+func (db *Db) keyTable() keyTable {
+	t := keyTable{index: db.index}
+	for _, seg := range db.segments {
+		if seg.keys != nil {
+			t.files = append(t.files, seg.keys)
+		}
+	}
+	return t
+}
+
+func (t keyTable) get(key string) (SegmentPos, bool, error) {
+	if pos, ok := t.index.get(key); ok {
+		return pos, !pos.deleted, nil
+	}
+	return t.sealedGet(key)
+}
+
+// sealedGet searches the key files alone.
+func (t keyTable) sealedGet(key string) (SegmentPos, bool, error) {
+	for i := len(t.files) - 1; i >= 0; i-- {
+		pos, ok, err := t.files[i].find(key)
+		if err != nil || ok {
+			return pos, ok && !pos.deleted, err
+		}
+	}
+	return SegmentPos{}, false, nil
+}
+
+// seek returns a cursor over the keys not less than start. Deleted keys show
+// up as tombstones.
+func (t keyTable) seek(start string) *mergeCursor {
+	sources := []keyCursor{t.index.seek(start)}
+	for i := len(t.files) - 1; i >= 0; i-- {
+		sources = append(sources, t.files[i].seek(start))
+	}
+	return newMergeCursor(sources)
+}
+
+// lookup returns the position of the key's latest record. It reports false
+// if the key is absent or deleted, but not if it has expired. Must be called
+// with db.mu held.
+//
+// Under the disk index, keys not in memory are answered from what the writer
+// prefetched for its group, as long as the sealed segments are still the same.
+// Only otherwise, such as right after a rollover, are key files read with
+// db.mu held.
+func (db *Db) lookup(key string) (SegmentPos, bool, error) {
+	pos, ok := db.index.get(key)
+	if !db.opts.DiskIndex {
+		return pos, ok, nil
+	}
+	if ok {
+		return pos, !pos.deleted, nil
+	}
+	if p := db.prefetched; p != nil && p.gen == db.segmentsGen {
+		if r, ok := p.keys[key]; ok {
+			return r.pos, r.ok, r.err
+		}
+	}
+	return db.keyTable().sealedGet(key)
+}
+
+// sealedLookups holds where the keys of a write group are in the key files,
+// looked up before the group takes db.mu.
+type sealedLookups struct {
+	// gen is db.segmentsGen at the time of the lookups.
+	gen  uint64
+	keys map[string]sealedLookup
+}
+
+type sealedLookup struct {
+	pos SegmentPos
+	ok  bool
+	err error
+}
+
+// prefetchSealed looks the keys up in the key files of the sealed segments.
+// db.mu is only held to take a snapshot, which keeps the key files open while
+// they are read.
+func (db *Db) prefetchSealed(keys []string) *sealedLookups {
+	db.mu.Lock()
+	snap := db.snapshotLocked()
+	gen := db.segmentsGen
+	db.mu.Unlock()
+	defer snap.Release()
+
+	p := &sealedLookups{gen: gen, keys: make(map[string]sealedLookup, len(keys))}
+	for _, key := range keys {
+		if _, done := p.keys[key]; done {
+			continue
+		}
+		pos, ok, err := snap.keys.sealedGet(key)
+		p.keys[key] = sealedLookup{pos: pos, ok: ok, err: err}
+	}
+	return p
+}
+
+// loadKeyFile opens the key file of a sealed segment, building it from the
+// segment's hints if it is missing or unusable.
+func (db *Db) loadKeyFile(seg *Segment) error {
+	keys, err := openKeyFile(seg.file.Name(), seg.num, seg.offset, db.keys)
+	if err == nil {
+		seg.keys = keys
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		db.logf("Ignoring key file for segment %d: %v", seg.num, err)
+	}
+
+	if db.opts.ReadOnly {
+		return fmt.Errorf("key file of segment %d cannot be rebuilt read-only: %w", seg.num, err)
+	}
+	hints, err := db.segmentHints(seg)
+	if err != nil {
+		return err
+	}
+	var idx keyIndex
+	for _, h := range hints {
+		idx.set(h.key, SegmentPos{segmentNum: seg.num, offset: h.offset, size: h.size, deleted: h.deleted, expiresAt: h.expiresAt, version: h.version})
+	}
+	if seg.keys, err = writeKeyFile(seg, idx.seek(""), db.keys); err != nil {
+		return fmt.Errorf("failed to write key file for segment %d: %w", seg.num, err)
+	}
+	return nil
+}
+
+// countLiveBytes sets the live bytes of the sealed segments and the key
+// count from their key files. It runs before the active segment is replayed,
+// which then moves the bytes it shadows to garbage as usual. Keys whose
+// records have expired are counted until a compaction drops them. Must be
+// called with db.mu held.
+func (db *Db) countLiveBytes() error {
+	now := time.Now().UnixNano()
+	cur := db.keyTable().seek("")
+	for n, ok := cur.next(); ok; n, ok = cur.next() {
+		if n.pos.deleted {
+			continue
+		}
+		db.keyCount++
+		if n.pos.expired(now) {
+			continue
+		}
+		if seg := db.findSegment(n.pos.segmentNum); seg != nil {
+			seg.liveBytes += n.pos.size
+		}
+	}
+	return cur.err()
+}
+
+// takeCompactionWrites returns the keys written during the running
+// compaction that are not in seen yet, and adds them to it. Must be called
+// with db.mu held.
+func (db *Db) takeCompactionWrites(seen map[string]struct{}) []string {
+	var keys []string
+	for key := range db.compactionWrites {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// replacedRecords accounts for the records replaced by the keys written
+// while a compaction ran.
+type replacedRecords struct {
+	// shadowed is the size of the merged segment's records among them.
+	shadowed int64
+	// expired is how many of them the compaction dropped as expired. The
+	// writes have taken those keys into account in the key count already.
+	expired int
+}
+
+// add accounts for more written keys, which are few compared to the merged
+// segment's. The compaction picked its records from table at time now.
+func (r *replacedRecords) add(keys []string, merged *keyFile, table keyTable, sources map[int]*Segment, now int64) error {
+	for _, key := range keys {
+		pos, found, err := merged.find(key)
+		if err != nil {
+			return err
+		}
+		if found {
+			r.shadowed += pos.size
+			continue
+		}
+		pos, found, err = table.get(key)
+		if err != nil {
+			return err
+		}
+		if found && sources[pos.segmentNum] != nil && pos.expired(now) {
+			r.expired++
+		}
+	}
+	return nil
+}
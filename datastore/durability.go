@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// SyncPolicy decides when appended records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system. Put returns as soon
+	// as the record is written to the segment file. Only sealing a segment
+	// flushes it.
+	SyncNever SyncPolicy = iota
+	// SyncAlways flushes every write before Put returns.
+	SyncAlways
+	// SyncInterval flushes in the background, so a crash loses at most the
+	// writes acknowledged during the last interval.
+	SyncInterval
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncNever, SyncAlways, SyncInterval} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q, expected one of: never, always, interval", s)
+}
+
+// WithSyncPolicy sets the durability guarantee of writes. The interval is
+// only used by SyncInterval.
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) Option {
+	return func(o *Options) {
+		o.SyncPolicy = policy
+		o.SyncInterval = interval
+	}
+}
+
+func (o *Options) validateSyncPolicy() error {
+	switch o.SyncPolicy {
+	case SyncNever, SyncAlways:
+		return nil
+	case SyncInterval:
+		if o.SyncInterval <= 0 {
+			return fmt.Errorf("sync interval must be positive, got %v", o.SyncInterval)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown sync policy %v", o.SyncPolicy)
+}
+
+// syncLoop flushes the active segment every syncInterval if it has been
+// written to since the last flush. The fsync itself runs without db.mu so
+// that writers are not blocked by it.
+func (db *Db) syncLoop() {
+	defer db.syncWg.Done()
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.syncStop:
+			return
+		case <-ticker.C:
+			db.syncActiveSegment()
+		}
+	}
+}
+
+func (db *Db) syncActiveSegment() {
+	db.mu.Lock()
+	seg := db.getActiveSegment()
+	dirty := db.dirty
+	db.dirty = false
+	seg.acquire()
+	db.mu.Unlock()
+	defer seg.release()
+
+	if !dirty {
+		return
+	}
+	if err := seg.file.Sync(); err != nil {
+		db.logf("Background sync of segment %d failed: %v", seg.num, err)
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
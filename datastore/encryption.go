@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownKey is returned when a record is encrypted with a key that was not
+// passed to WithEncryption.
+var ErrUnknownKey = errors.New("record is encrypted with an unknown key")
+
+// EncryptionKey is an AES-128, AES-192 or AES-256 key. Its ID is stamped into
+// every record it encrypts, so that the record can still be decrypted after
+// newer keys have been added.
+type EncryptionKey struct {
+	ID  uint32
+	Key []byte
+}
+
+// WithEncryption encrypts the key and value of every new record with AES-GCM
+// under the key with the highest ID. All keys are used for decryption, so to
+// rotate keys a new one is added while the old ones are kept until every
+// segment written under them has been compacted, which rewrites the records
+// under the new key.
+func WithEncryption(keys ...EncryptionKey) Option {
+	return func(o *Options) {
+		o.EncryptionKeys = keys
+	}
+}
+
+// ParseEncryptionKeys parses keys written as "<id>:<hex key>", separated by
+// commas or whitespace.
+func ParseEncryptionKeys(s string) ([]EncryptionKey, error) {
+	var keys []EncryptionKey
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		idStr, keyHex, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption key %q is not in <id>:<hex key> form", field)
+		}
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key id %q: %w", idStr, err)
+		}
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", id, err)
+		}
+		keys = append(keys, EncryptionKey{ID: uint32(id), Key: key})
+	}
+	return keys, nil
+}
+
+// keyring holds the ciphers of the configured keys. A nil keyring leaves
+// records in plaintext.
+type keyring struct {
+	aeads   map[uint32]cipher.AEAD
+	current uint32
+}
+
+func newKeyring(keys []EncryptionKey) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	k := &keyring{aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if _, dup := k.aeads[key.ID]; dup {
+			return nil, fmt.Errorf("duplicate encryption key id %d", key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", key.ID, err)
+		}
+		k.aeads[key.ID] = aead
+		if key.ID > k.current || len(k.aeads) == 1 {
+			k.current = key.ID
+		}
+	}
+	return k, nil
+}
+
+// Sealed data layout:
+//
+// 0        4       16             <-- offset
+// (key id) (nonce) (ciphertext)
+
+const sealedHeaderSize = 4 + 12
+
+func (k *keyring) seal(plaintext, aad []byte) []byte {
+	aead := k.aeads[k.current]
+	res := make([]byte, sealedHeaderSize, sealedHeaderSize+len(plaintext)+aead.Overhead())
+	binary.LittleEndian.PutUint32(res, k.current)
+	if _, err := rand.Read(res[4:sealedHeaderSize]); err != nil {
+		panic(fmt.Sprintf("cannot generate nonce: %v", err))
+	}
+	return aead.Seal(res, res[4:sealedHeaderSize], plaintext, aad)
+}
+
+func (k *keyring) open(data, aad []byte) ([]byte, error) {
+	if len(data) < sealedHeaderSize {
+		return nil, fmt.Errorf("%w: encrypted data too short", ErrCorrupted)
+	}
+	id := binary.LittleEndian.Uint32(data)
+	var aead cipher.AEAD
+	if k != nil {
+		aead = k.aeads[id]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: key id %d", ErrUnknownKey, id)
+	}
+	plaintext, err := aead.Open(nil, data[4:sealedHeaderSize], data[sealedHeaderSize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decrypt with key %d: %v", ErrCorrupted, id, err)
+	}
+	return plaintext, nil
+}
+
+// encrypt replaces the key and value of the record with their ciphertext,
+// which goes into the value field. The header is authenticated along with it.
+func (k *keyring) encrypt(e *entry) {
+	if k == nil || e.encrypted {
+		return
+	}
+	plaintext := make([]byte, 4+len(e.key)+len(e.value))
+	binary.LittleEndian.PutUint32(plaintext, uint32(len(e.key)))
+	copy(plaintext[4:], e.key)
+	copy(plaintext[4+len(e.key):], e.value)
+
+	e.encrypted = true
+	e.value = string(k.seal(plaintext, e.headerData()))
+	e.key = ""
+}
+
+// stale reports whether a record with the given value has to be re-encrypted
+// to end up under the current key.
+func (k *keyring) stale(encrypted bool, value []byte) bool {
+	if k == nil {
+		return false
+	}
+	return !encrypted || len(value) < 4 || binary.LittleEndian.Uint32(value) != k.current
+}
+
+func (k *keyring) decrypt(e *entry) error {
+	if !e.encrypted {
+		return nil
+	}
+	plaintext, err := k.open([]byte(e.value), e.headerData())
+	if err != nil {
+		return err
+	}
+	kl := int(binary.LittleEndian.Uint32(plaintext))
+	if kl > len(plaintext)-4 {
+		return fmt.Errorf("%w: invalid encrypted key length", ErrCorrupted)
+	}
+	if e.isInt64 && len(plaintext)-4-kl != 8 {
+		return fmt.Errorf("%w: invalid int64 value length", ErrCorrupted)
+	}
+	e.key = string(plaintext[4 : 4+kl])
+	e.value = string(plaintext[4+kl:])
+	e.encrypted = false
+	return nil
+}
@@ -5,57 +5,197 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"strconv"
+)
+
+const (
+	kindValue byte = iota
+	kindTombstone
+	// kindInt64 marks a value stored as an int64 in 8 little-endian bytes.
+	kindInt64
+)
+
+const (
+	// flagContinued is set in the kind byte of every record of a write batch
+	// but the last one, so a batch cut short by a crash can be recognised and
+	// dropped.
+	flagContinued byte = 0x80
+	// flagCompressed is set in the kind byte of records whose value is
+	// deflated, see compressValue.
+	flagCompressed byte = 0x40
+	// flagEncrypted is set in the kind byte of records whose key and value
+	// are encrypted together into the value field, see keyring.encrypt.
+	flagEncrypted byte = 0x20
+
+	kindFlags = flagContinued | flagCompressed | flagEncrypted
 )
 
 type entry struct {
 	key, value string
+	deleted    bool
+	continued  bool
+	compressed bool
+	encrypted  bool
+	// isInt64 is set when value holds an int64 in binary form, see
+	// int64Entry.
+	isInt64 bool
+	// expiresAt is the Unix time in nanoseconds after which the record is
+	// treated as absent, or 0 if it never expires.
+	expiresAt int64
+	// version counts the writes of the key, starting from 1.
+	version uint64
 }
 
-// 0           4    8     kl+8  kl+12     <-- offset
-// (full size) (kl) (key) (vl)  (value)
-// 4           4    ....  4     .....     <-- length
+// 0           4     8      9         17        25   29    kl+29 kl+33     <-- offset
+// (full size) (crc) (kind) (expires) (version) (kl) (key) (vl)  (value)
+// 4           4     1      8         8         4    ....  4     .....     <-- length
+//
+// crc is the CRC32 (IEEE) of everything that follows it.
+
+const (
+	keyOffset  = 29
+	headerSize = keyOffset + 4
+)
 
 func (e *entry) Encode() []byte {
 	kl, vl := len(e.key), len(e.value)
-	size := kl + vl + 12
+	size := kl + vl + headerSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	e.putHeader(res[8:25])
+	binary.LittleEndian.PutUint32(res[25:], uint32(kl))
+	copy(res[keyOffset:], e.key)
+	binary.LittleEndian.PutUint32(res[keyOffset+kl:], uint32(vl))
+	copy(res[headerSize+kl:], e.value)
+	binary.LittleEndian.PutUint32(res[4:], crc32.ChecksumIEEE(res[8:]))
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	key := decodeString(input[4:])
-	keyLen := len(key)
-	val := decodeString(input[4+4+keyLen:])
-	e.key = key
-	e.value = val
+// putHeader writes the kind, expiry and version fields of the record.
+func (e *entry) putHeader(buf []byte) {
+	buf[0] = kindValue
+	if e.deleted {
+		buf[0] = kindTombstone
+	} else if e.isInt64 {
+		buf[0] = kindInt64
+	}
+	if e.continued {
+		buf[0] |= flagContinued
+	}
+	if e.compressed {
+		buf[0] |= flagCompressed
+	}
+	if e.encrypted {
+		buf[0] |= flagEncrypted
+	}
+	binary.LittleEndian.PutUint64(buf[1:], uint64(e.expiresAt))
+	binary.LittleEndian.PutUint64(buf[9:], e.version)
+}
+
+// headerData returns the kind, expiry and version fields as they are encoded.
+func (e *entry) headerData() []byte {
+	buf := make([]byte, 17)
+	e.putHeader(buf)
+	return buf
+}
+
+func (e *entry) Decode(input []byte) error {
+	if len(input) < headerSize || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return fmt.Errorf("%w: invalid record size", ErrCorrupted)
+	}
+	if crc32.ChecksumIEEE(input[8:]) != binary.LittleEndian.Uint32(input[4:]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	kl := int(binary.LittleEndian.Uint32(input[25:]))
+	if kl > len(input)-headerSize {
+		return fmt.Errorf("%w: invalid key length", ErrCorrupted)
+	}
+	vl := int(binary.LittleEndian.Uint32(input[keyOffset+kl:]))
+	if kl+vl+headerSize != len(input) {
+		return fmt.Errorf("%w: invalid value length", ErrCorrupted)
+	}
+	kind := input[8] &^ kindFlags
+	encrypted := input[8]&flagEncrypted != 0
+	if kind == kindInt64 && !encrypted && vl != 8 {
+		return fmt.Errorf("%w: invalid int64 value length", ErrCorrupted)
+	}
+	e.key = string(input[keyOffset : keyOffset+kl])
+	e.value = string(input[headerSize+kl:])
+	e.deleted = kind == kindTombstone
+	e.isInt64 = kind == kindInt64
+	e.continued = input[8]&flagContinued != 0
+	e.compressed = input[8]&flagCompressed != 0
+	e.encrypted = encrypted
+	e.expiresAt = int64(binary.LittleEndian.Uint64(input[9:]))
+	e.version = binary.LittleEndian.Uint64(input[17:])
+	return nil
+}
+
+func int64Entry(key string, value int64) entry {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(value))
+	return entry{key: key, value: string(buf[:]), isInt64: true}
 }
 
-func decodeString(v []byte) string {
-	l := binary.LittleEndian.Uint32(v)
-	buf := make([]byte, l)
-	copy(buf, v[4:4+int(l)])
-	return string(buf)
+func (e *entry) int64Value() int64 {
+	return int64(binary.LittleEndian.Uint64([]byte(e.value)))
+}
+
+// stringValue returns the value as Get reports it: int64 values are formatted
+// in decimal.
+func (e *entry) stringValue() string {
+	if e.isInt64 {
+		return strconv.FormatInt(e.int64Value(), 10)
+	}
+	return e.value
+}
+
+// peekRecord checks an encoded record and returns its kind byte and value
+// without copying anything, for callers that pass records on as they are.
+func peekRecord(input []byte) (byte, []byte, error) {
+	if len(input) < headerSize || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return 0, nil, fmt.Errorf("%w: invalid record size", ErrCorrupted)
+	}
+	if crc32.ChecksumIEEE(input[8:]) != binary.LittleEndian.Uint32(input[4:]) {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	kl := int(binary.LittleEndian.Uint32(input[25:]))
+	if kl > len(input)-headerSize {
+		return 0, nil, fmt.Errorf("%w: invalid key length", ErrCorrupted)
+	}
+	return input[8], input[headerSize+kl:], nil
+}
+
+// expired reports whether the record has outlived its TTL at the given Unix
+// time in nanoseconds.
+func expired(expiresAt, now int64) bool {
+	return expiresAt != 0 && expiresAt <= now
 }
 
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
-			return 0, err
+			if len(sizeBuf) == 0 {
+				return 0, err
+			}
+			err = io.ErrUnexpectedEOF
 		}
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
-	buf := make([]byte, int(binary.LittleEndian.Uint32(sizeBuf)))
-	n, err := in.Read(buf[:])
+	size := int(binary.LittleEndian.Uint32(sizeBuf))
+	if size < headerSize {
+		return 0, fmt.Errorf("DecodeFromReader: %w: invalid record size %d", ErrCorrupted, size)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
 		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
-	e.Decode(buf)
+	if err := e.Decode(buf); err != nil {
+		return n, fmt.Errorf("DecodeFromReader: %w", err)
+	}
 	return n, nil
 }
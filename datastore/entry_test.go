@@ -3,11 +3,13 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"strings"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -17,11 +19,124 @@ func TestEntry_Encode(t *testing.T) {
 	}
 }
 
+func TestEntry_Tombstone(t *testing.T) {
+	e := entry{key: "key", deleted: true}
+	var got entry
+	got.Decode(e.Encode())
+	if got != e {
+		t.Errorf("tombstone mismatch: got %v, want %v", got, e)
+	}
+}
+
+func TestEntry_Expiry(t *testing.T) {
+	e := entry{key: "key", value: "value", expiresAt: 1700000000000000000}
+	var got entry
+	if err := got.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if got != e {
+		t.Errorf("expiry mismatch: got %v, want %v", got, e)
+	}
+	if !expired(got.expiresAt, got.expiresAt) || expired(got.expiresAt, got.expiresAt-1) || expired(0, got.expiresAt) {
+		t.Error("unexpected expired() result")
+	}
+}
+
+func TestEntry_Version(t *testing.T) {
+	e := entry{key: "key", value: "value", version: 42}
+	var got entry
+	if err := got.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if got != e {
+		t.Errorf("version mismatch: got %v, want %v", got, e)
+	}
+}
+
+func TestEntry_Int64(t *testing.T) {
+	e := int64Entry("key", -42)
+	var got entry
+	if err := got.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if got != e || got.stringValue() != "-42" {
+		t.Errorf("int64 mismatch: got %v (%s), want %v", got, got.stringValue(), e)
+	}
+
+	e = entry{key: "key", value: "short", isInt64: true}
+	if err := got.Decode(e.Encode()); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected ErrCorrupted for bad int64 length, got %v", err)
+	}
+}
+
+func TestEntry_Compressed(t *testing.T) {
+	db := &Db{opts: Options{CompressThreshold: 16}}
+	value := strings.Repeat("compressible ", 20)
+	e := entry{key: "key", value: value, continued: true}
+	db.compressValue(&e)
+	if !e.compressed || len(e.value) >= len(value) {
+		t.Fatalf("expected value to be compressed, got %d bytes", len(e.value))
+	}
+
+	var got entry
+	if err := got.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if got != e {
+		t.Errorf("compressed mismatch: got %v, want %v", got, e)
+	}
+	if err := got.decompress(); err != nil || got.value != value || got.compressed {
+		t.Errorf("decompress = %q, %v", got.value, err)
+	}
+
+	small := entry{key: "key", value: "short"}
+	db.compressValue(&small)
+	if small.compressed {
+		t.Error("expected value below threshold to stay uncompressed")
+	}
+}
+
+func TestEntry_Encrypted(t *testing.T) {
+	ring, err := newKeyring([]EncryptionKey{{ID: 1, Key: bytes.Repeat([]byte{1}, 32)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := entry{key: "secret-key", value: "secret-value", version: 3}
+	e := plain
+	ring.encrypt(&e)
+	data := e.Encode()
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("encoded record contains plaintext")
+	}
+
+	var got entry
+	if err := got.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.decrypt(&got); err != nil || got != plain {
+		t.Errorf("decrypt = %v, %v, want %v", got, err, plain)
+	}
+
+	got = entry{}
+	if err := got.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	got.version++
+	if err := ring.decrypt(&got); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected ErrCorrupted for tampered header, got %v", err)
+	}
+	got.version--
+	var noKeys *keyring
+	if err := noKeys.decrypt(&got); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
 func TestReadValue(t *testing.T) {
 	var (
 		a, b entry
 	)
-	a = entry{"key", "test-value"}
+	a = entry{key: "key", value: "test-value"}
 	originalBytes := a.Encode()
 
 	b.Decode(originalBytes)
@@ -43,3 +158,18 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(originalBytes))
 	}
 }
+
+func TestEntry_Checksum(t *testing.T) {
+	e := entry{key: "key", value: "value"}
+	data := e.Encode()
+	data[len(data)-1] ^= 0x01
+
+	var got entry
+	if err := got.Decode(data); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Decode: expected ErrCorrupted, got %v", err)
+	}
+	_, err := got.DecodeFromReader(bufio.NewReader(bytes.NewReader(data)))
+	if !errors.Is(err, ErrCorrupted) {
+		t.Errorf("DecodeFromReader: expected ErrCorrupted, got %v", err)
+	}
+}
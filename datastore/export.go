@@ -0,0 +1,154 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrInvalidImport is returned by Import for input that is not a valid
+// export.
+var ErrInvalidImport = errors.New("invalid import data")
+
+// importBatchSize is the number of keys Import commits in one write batch.
+const importBatchSize = 1000
+
+// exportLine is one line of an export: a JSON object per key. Values that are
+// not valid UTF-8 cannot be carried by a JSON string and are base64-encoded
+// in ValueBase64 instead. Values written by PutInt64 or Increment are
+// exported in decimal, which Get, GetInt64 and Increment treat the same way.
+type exportLine struct {
+	Key         string     `json:"key"`
+	Value       *string    `json:"value,omitempty"`
+	ValueBase64 *string    `json:"value_base64,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// Export writes every key with its value to w as JSON Lines, in key order.
+// It reads from a snapshot, so writes made meanwhile are not included and
+// are not held off. Values are read one at a time and bypass the value cache.
+// It returns the number of keys written.
+func (db *Db) Export(w io.Writer) (int, error) {
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+
+	var count int
+	cur := snap.keys.seek("")
+	for n, ok := cur.next(); ok; n, ok = cur.next() {
+		if n.pos.deleted || n.pos.expired(snap.createdAt) {
+			continue
+		}
+		seg := snap.segment(n.pos.segmentNum)
+		if seg == nil {
+			return count, fmt.Errorf("segment %d for key %s not found in snapshot", n.pos.segmentNum, n.key)
+		}
+		value, err := readRecordFromFile(n.key, n.pos, seg.file, db.keys)
+		if err != nil {
+			return count, err
+		}
+
+		line := exportLine{Key: n.key}
+		if utf8.ValidString(value) {
+			line.Value = &value
+		} else {
+			encoded := base64.StdEncoding.EncodeToString([]byte(value))
+			line.ValueBase64 = &encoded
+		}
+		if n.pos.expiresAt != 0 {
+			expiresAt := time.Unix(0, n.pos.expiresAt).UTC()
+			line.ExpiresAt = &expiresAt
+		}
+		if err := enc.Encode(line); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := cur.err(); err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+// Import stores the keys of an export read from r, overwriting keys that
+// already exist. Keys are committed in batches as the input is read, so an
+// error part way leaves the keys of the batches before it in place. Keys
+// that have expired by the time they are read are skipped. It returns the
+// number of keys stored.
+func (db *Db) Import(r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.DisallowUnknownFields()
+
+	var batch WriteBatch
+	var imported int
+	commit := func() error {
+		if err := db.Write(&batch); err != nil {
+			return err
+		}
+		imported += batch.Len()
+		batch = WriteBatch{}
+		return nil
+	}
+
+	for lineNum := 1; ; lineNum++ {
+		var line exportLine
+		err := dec.Decode(&line)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("%w: record %d: %v", ErrInvalidImport, lineNum, err)
+		}
+		record, err := line.entry()
+		if err != nil {
+			return imported, fmt.Errorf("%w: record %d: %v", ErrInvalidImport, lineNum, err)
+		}
+		if expired(record.expiresAt, time.Now().UnixNano()) {
+			continue
+		}
+
+		batch.ops = append(batch.ops, record)
+		if batch.Len() == importBatchSize {
+			if err := commit(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := commit(); err != nil {
+		return imported, err
+	}
+	return imported, nil
+}
+
+func (line exportLine) entry() (entry, error) {
+	if line.Key == "" {
+		return entry{}, errors.New("key is empty")
+	}
+	record := entry{key: line.Key}
+	switch {
+	case line.Value != nil && line.ValueBase64 != nil:
+		return entry{}, fmt.Errorf("key %s has both value and value_base64", line.Key)
+	case line.Value != nil:
+		record.value = *line.Value
+	case line.ValueBase64 != nil:
+		value, err := base64.StdEncoding.DecodeString(*line.ValueBase64)
+		if err != nil {
+			return entry{}, fmt.Errorf("key %s: %v", line.Key, err)
+		}
+		record.value = string(value)
+	default:
+		return entry{}, fmt.Errorf("key %s has no value", line.Key)
+	}
+	if line.ExpiresAt != nil {
+		record.expiresAt = line.ExpiresAt.UnixNano()
+	}
+	return record, nil
+}
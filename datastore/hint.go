@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const hintSuffix = ".hint"
+
+// hintEntry is what recovery needs to know about a record without reading
+// its value: the key and where the record starts in the segment.
+type hintEntry struct {
+	key    string
+	offset int64
+	// size is not stored in hint files; records follow each other, so it is
+	// derived from the offset of the next one.
+	size      int64
+	deleted   bool
+	expiresAt int64
+	version   uint64
+}
+
+// Hint file layout:
+//
+// 0              8       12    16       <-- offset
+// (segment size) (count) (crc) (entries...)
+//
+// crc is the CRC32 (IEEE) of all entries. Each entry is
+//
+// 0        8      9         17        25   29       <-- offset
+// (offset) (kind) (expires) (version) (kl) (key)
+//
+// The segment size ties the hint to the exact segment contents it was made
+// from, so a hint left over from an older file with the same name is ignored.
+
+const (
+	hintHeaderSize = 16
+	hintEntrySize  = 29
+)
+
+func hintPath(segmentPath string) string {
+	return segmentPath + hintSuffix
+}
+
+func encodeHints(segmentSize int64, hints []hintEntry) []byte {
+	size := hintHeaderSize
+	for _, h := range hints {
+		size += hintEntrySize + len(h.key)
+	}
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint64(res, uint64(segmentSize))
+	binary.LittleEndian.PutUint32(res[8:], uint32(len(hints)))
+
+	pos := hintHeaderSize
+	for _, h := range hints {
+		binary.LittleEndian.PutUint64(res[pos:], uint64(h.offset))
+		res[pos+8] = kindValue
+		if h.deleted {
+			res[pos+8] = kindTombstone
+		}
+		binary.LittleEndian.PutUint64(res[pos+9:], uint64(h.expiresAt))
+		binary.LittleEndian.PutUint64(res[pos+17:], h.version)
+		binary.LittleEndian.PutUint32(res[pos+25:], uint32(len(h.key)))
+		copy(res[pos+hintEntrySize:], h.key)
+		pos += hintEntrySize + len(h.key)
+	}
+	binary.LittleEndian.PutUint32(res[12:], crc32.ChecksumIEEE(res[hintHeaderSize:]))
+	return res
+}
+
+func decodeHints(data []byte, segmentSize int64) ([]hintEntry, error) {
+	if len(data) < hintHeaderSize {
+		return nil, fmt.Errorf("%w: hint file too short", ErrCorrupted)
+	}
+	if got := int64(binary.LittleEndian.Uint64(data)); got != segmentSize {
+		return nil, fmt.Errorf("stale hint file: made for %d bytes of segment, segment has %d", got, segmentSize)
+	}
+	if crc32.ChecksumIEEE(data[hintHeaderSize:]) != binary.LittleEndian.Uint32(data[12:]) {
+		return nil, fmt.Errorf("%w: hint checksum mismatch", ErrCorrupted)
+	}
+
+	count := int(binary.LittleEndian.Uint32(data[8:]))
+	hints := make([]hintEntry, 0, count)
+	pos := hintHeaderSize
+	for i := 0; i < count; i++ {
+		if pos+hintEntrySize > len(data) {
+			return nil, fmt.Errorf("%w: truncated hint entry", ErrCorrupted)
+		}
+		kl := int(binary.LittleEndian.Uint32(data[pos+25:]))
+		if pos+hintEntrySize+kl > len(data) {
+			return nil, fmt.Errorf("%w: truncated hint key", ErrCorrupted)
+		}
+		hints = append(hints, hintEntry{
+			key:       string(data[pos+hintEntrySize : pos+hintEntrySize+kl]),
+			offset:    int64(binary.LittleEndian.Uint64(data[pos:])),
+			deleted:   data[pos+8] == kindTombstone,
+			expiresAt: int64(binary.LittleEndian.Uint64(data[pos+9:])),
+			version:   binary.LittleEndian.Uint64(data[pos+17:]),
+		})
+		pos += hintEntrySize + kl
+	}
+	for i := range hints {
+		end := segmentSize
+		if i+1 < len(hints) {
+			end = hints[i+1].offset
+		}
+		hints[i].size = end - hints[i].offset
+	}
+	return hints, nil
+}
+
+// writeHintFile goes through a temporary file so a crash never leaves a
+// half-written hint under the final name. Hints hold keys, so they are
+// encrypted as a whole when the segments are.
+func writeHintFile(segmentPath string, segmentSize int64, hints []hintEntry, ring *keyring) error {
+	path := hintPath(segmentPath)
+	tmpPath := path + ".tmp"
+	data := encodeHints(segmentSize, hints)
+	if ring != nil {
+		data = ring.seal(data, nil)
+	}
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func readHintFile(segmentPath string, segmentSize int64, ring *keyring) ([]hintEntry, error) {
+	data, err := os.ReadFile(hintPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	if ring != nil {
+		if data, err = ring.open(data, nil); err != nil {
+			return nil, err
+		}
+	}
+	return decodeHints(data, segmentSize)
+}
@@ -0,0 +1,162 @@
+package datastore
+
+import "math/rand/v2"
+
+// keyIndex maps keys to the positions of their latest records and keeps the
+// keys sorted. It is a persistent treap: an update copies the nodes on the
+// path to the changed key instead of modifying them, so a copy of a keyIndex
+// value is a frozen view that stays valid while the original keeps changing.
+type keyIndex struct {
+	root *indexNode
+	size int
+}
+
+type indexNode struct {
+	key         string
+	pos         SegmentPos
+	priority    uint32
+	left, right *indexNode
+}
+
+func (idx *keyIndex) len() int {
+	return idx.size
+}
+
+func (idx *keyIndex) get(key string) (SegmentPos, bool) {
+	n := idx.root
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n.pos, true
+		}
+	}
+	return SegmentPos{}, false
+}
+
+func (idx *keyIndex) set(key string, pos SegmentPos) {
+	var added bool
+	idx.root = insertNode(idx.root, key, pos, &added)
+	if added {
+		idx.size++
+	}
+}
+
+func (idx *keyIndex) delete(key string) bool {
+	var removed bool
+	idx.root = deleteNode(idx.root, key, &removed)
+	if removed {
+		idx.size--
+	}
+	return removed
+}
+
+// insertNode returns the root of a tree holding key. Nodes returned from the
+// recursive call are always fresh copies, so rotating them is safe.
+func insertNode(n *indexNode, key string, pos SegmentPos, added *bool) *indexNode {
+	if n == nil {
+		*added = true
+		return &indexNode{key: key, pos: pos, priority: rand.Uint32()}
+	}
+	c := *n
+	switch {
+	case key < n.key:
+		c.left = insertNode(n.left, key, pos, added)
+		if c.left.priority > c.priority {
+			l := c.left
+			c.left = l.right
+			l.right = &c
+			return l
+		}
+	case key > n.key:
+		c.right = insertNode(n.right, key, pos, added)
+		if c.right.priority > c.priority {
+			r := c.right
+			c.right = r.left
+			r.left = &c
+			return r
+		}
+	default:
+		c.pos = pos
+	}
+	return &c
+}
+
+func deleteNode(n *indexNode, key string, removed *bool) *indexNode {
+	if n == nil {
+		return nil
+	}
+	switch {
+	case key < n.key:
+		left := deleteNode(n.left, key, removed)
+		if !*removed {
+			return n
+		}
+		c := *n
+		c.left = left
+		return &c
+	case key > n.key:
+		right := deleteNode(n.right, key, removed)
+		if !*removed {
+			return n
+		}
+		c := *n
+		c.right = right
+		return &c
+	}
+	*removed = true
+	return mergeNodes(n.left, n.right)
+}
+
+// mergeNodes joins two trees where every key of a is less than every key of b.
+func mergeNodes(a, b *indexNode) *indexNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		c := *a
+		c.right = mergeNodes(a.right, b)
+		return &c
+	}
+	c := *b
+	c.left = mergeNodes(a, b.left)
+	return &c
+}
+
+// indexCursor walks a frozen index in key order.
+type indexCursor struct {
+	stack []*indexNode
+}
+
+// seek positions the cursor before the first key that is not less than start.
+func (idx *keyIndex) seek(start string) *indexCursor {
+	cur := &indexCursor{}
+	n := idx.root
+	for n != nil {
+		if n.key < start {
+			n = n.right
+		} else {
+			cur.stack = append(cur.stack, n)
+			n = n.left
+		}
+	}
+	return cur
+}
+
+func (cur *indexCursor) next() (*indexNode, bool) {
+	if len(cur.stack) == 0 {
+		return nil, false
+	}
+	n := cur.stack[len(cur.stack)-1]
+	cur.stack = cur.stack[:len(cur.stack)-1]
+	for c := n.right; c != nil; c = c.left {
+		cur.stack = append(cur.stack, c)
+	}
+	return n, true
+}
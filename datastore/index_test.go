@@ -0,0 +1,173 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	var idx keyIndex
+	expected := make(map[string]SegmentPos)
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", rand.IntN(1000))
+		if rand.IntN(3) == 0 {
+			_, want := expected[key]
+			if got := idx.delete(key); got != want {
+				t.Fatalf("delete(%s) = %v, want %v", key, got, want)
+			}
+			delete(expected, key)
+		} else {
+			pos := SegmentPos{segmentNum: i, offset: int64(i)}
+			idx.set(key, pos)
+			expected[key] = pos
+		}
+	}
+
+	if idx.len() != len(expected) {
+		t.Errorf("len() = %d, want %d", idx.len(), len(expected))
+	}
+	for key, want := range expected {
+		if got, ok := idx.get(key); !ok || got != want {
+			t.Errorf("get(%s) = %v, %v, want %v", key, got, ok, want)
+		}
+	}
+
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cur := idx.seek("")
+	for _, want := range keys {
+		n, ok := cur.next()
+		if !ok || n.key != want {
+			t.Fatalf("unexpected key in ordered walk: got %v, want %s", n, want)
+		}
+	}
+	if _, ok := cur.next(); ok {
+		t.Error("expected ordered walk to end")
+	}
+
+	start := keys[len(keys)/2]
+	if n, ok := idx.seek(start).next(); !ok || n.key != start {
+		t.Errorf("seek(%s) started at %v", start, n)
+	}
+}
+
+func TestKeyIndex_FrozenCopy(t *testing.T) {
+	var idx keyIndex
+	idx.set("a", SegmentPos{segmentNum: 1, offset: 0})
+	idx.set("b", SegmentPos{segmentNum: 1, offset: 10})
+
+	frozen := idx
+	idx.set("a", SegmentPos{segmentNum: 2, offset: 0})
+	idx.delete("b")
+	idx.set("c", SegmentPos{segmentNum: 2, offset: 10})
+
+	if pos, ok := frozen.get("a"); !ok || pos != (SegmentPos{segmentNum: 1, offset: 0}) {
+		t.Errorf("frozen copy sees updated a: %v, %v", pos, ok)
+	}
+	if _, ok := frozen.get("b"); !ok {
+		t.Error("frozen copy lost deleted b")
+	}
+	if _, ok := frozen.get("c"); ok {
+		t.Error("frozen copy sees inserted c")
+	}
+	if frozen.len() != 2 || idx.len() != 2 {
+		t.Errorf("unexpected sizes: frozen=%d, current=%d", frozen.len(), idx.len())
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	ring, err := newKeyring([]EncryptionKey{{ID: 1, Key: make([]byte, 32)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		ring *keyring
+	}{{"plain", nil}, {"encrypted", ring}} {
+		t.Run(tc.name, func(t *testing.T) {
+			segmentPath := filepath.Join(t.TempDir(), segmentName(7))
+			w, err := createKeyFile(segmentPath, tc.ring)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			expected := make(map[string]SegmentPos)
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key%04d", i*2)
+				pos := SegmentPos{segmentNum: 7, offset: int64(i * 100), size: 100, version: uint64(i), deleted: i%10 == 0}
+				if err := w.add(key, pos); err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+				expected[key] = pos
+			}
+			if err := w.finish(100000); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := openKeyFile(segmentPath, 7, 99999, tc.ring); err == nil {
+				t.Error("expected a key file made for another segment size to be rejected")
+			}
+			k, err := openKeyFile(segmentPath, 7, 100000, tc.ring)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer k.close()
+			if len(k.blocks) < 2 {
+				t.Fatalf("expected several blocks, got %d", len(k.blocks))
+			}
+
+			for key, want := range expected {
+				if got, ok, err := k.find(key); err != nil || !ok || got != want {
+					t.Errorf("find(%s) = %v, %v, %v, want %v", key, got, ok, err, want)
+				}
+			}
+			for _, key := range []string{"a", "key0001", "key1001", "key9999"} {
+				if pos, ok, err := k.find(key); err != nil || ok {
+					t.Errorf("find(%s) = %v, %v, %v, want nothing", key, pos, ok, err)
+				}
+			}
+
+			start := "key1001"
+			cur := k.seek(start)
+			i := sort.SearchStrings(keys, start)
+			for n, ok := cur.next(); ok; n, ok = cur.next() {
+				if i >= len(keys) || n.key != keys[i] {
+					t.Fatalf("unexpected key in ordered walk: got %s, want index %d", n.key, i)
+				}
+				i++
+			}
+			if cur.err() != nil || i != len(keys) {
+				t.Errorf("ordered walk ended at %d of %d: %v", i, len(keys), cur.err())
+			}
+		})
+	}
+}
+
+func TestMergeCursor(t *testing.T) {
+	var newer, older keyIndex
+	older.set("a", SegmentPos{segmentNum: 1})
+	older.set("b", SegmentPos{segmentNum: 1})
+	older.set("d", SegmentPos{segmentNum: 1})
+	newer.set("b", SegmentPos{segmentNum: 2, deleted: true})
+	newer.set("c", SegmentPos{segmentNum: 2})
+	newer.set("d", SegmentPos{segmentNum: 2})
+
+	cur := newMergeCursor([]keyCursor{newer.seek(""), older.seek("")})
+	var got []string
+	for n, ok := cur.next(); ok; n, ok = cur.next() {
+		got = append(got, fmt.Sprintf("%s:%d:%v", n.key, n.pos.segmentNum, n.pos.deleted))
+	}
+	want := []string{"a:1:false", "b:2:true", "c:2:false", "d:2:false"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("merged walk = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,206 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Segments of the original format, written before there were manifests, hold
+// records with no checksum, kind, expiry or version:
+//
+// 0           4    8     kl+8  kl+12     <-- offset
+// (full size) (kl) (key) (vl)  (value)
+// 4           4    ....  4     .....     <-- length
+//
+// Open converts such a directory by rewriting its records into new segments
+// in a subdirectory, next to their manifest, and moving them in. The manifest
+// goes last, so the conversion takes effect in one step; the old segments are
+// only removed afterwards, as orphans.
+
+const (
+	legacyHeaderSize = 12
+	// convertDirName is the subdirectory a conversion writes to.
+	convertDirName = "convert"
+)
+
+// convertLegacy converts the segments of the original format with the given
+// numbers and returns the numbers of the new ones. A conversion interrupted
+// while moving its segments in is finished rather than started over.
+func (db *Db) convertLegacy(nums []int) ([]int, error) {
+	convertDir := filepath.Join(db.dir, convertDirName)
+	converted, err := readManifest(convertDir)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.RemoveAll(convertDir); err != nil {
+			return nil, err
+		}
+		converted, err = db.writeConverted(convertDir, nums)
+		if err != nil {
+			os.RemoveAll(convertDir)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, num := range converted {
+		name := segmentName(num)
+		if err := os.Rename(filepath.Join(convertDir, name), filepath.Join(db.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if err := syncDir(db.dir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(convertDir, manifestName), filepath.Join(db.dir, manifestName)); err != nil {
+		return nil, err
+	}
+	if err := syncDir(db.dir); err != nil {
+		return nil, err
+	}
+	db.logf("Converted %d segments of the original format into %d", len(nums), len(converted))
+	return converted, nil
+}
+
+// writeConverted rewrites the records of the legacy segments into new
+// segments in dir, numbered after the legacy ones, and writes their manifest.
+func (db *Db) writeConverted(dir string, legacy []int) ([]int, error) {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &legacyConverter{db: db, dir: dir, next: legacy[len(legacy)-1] + 1, versions: make(map[string]uint64)}
+	for i, num := range legacy {
+		if err := c.convertSegment(num, i == len(legacy)-1); err != nil {
+			c.closeSegment()
+			return nil, err
+		}
+	}
+	if err := c.closeSegment(); err != nil {
+		return nil, err
+	}
+	if err := writeManifest(dir, c.nums); err != nil {
+		return nil, err
+	}
+	return c.nums, nil
+}
+
+// legacyConverter writes converted records to new segments, starting the next
+// one once a segment reaches the maximum size.
+type legacyConverter struct {
+	db  *Db
+	dir string
+
+	nums   []int
+	next   int
+	out    *os.File
+	buf    *bufio.Writer
+	offset int64
+
+	// versions counts the records of each key, which become its versions.
+	versions map[string]uint64
+}
+
+// convertSegment converts the records of a legacy segment in order. Only the
+// last segment may end in a record cut short by a crash, which is dropped.
+func (c *legacyConverter) convertSegment(num int, isLast bool) error {
+	f, err := os.Open(filepath.Join(c.db.dir, segmentName(num)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for offset < stat.Size() {
+		key, value, size, err := readLegacyRecord(r, stat.Size()-offset)
+		if errors.Is(err, io.ErrUnexpectedEOF) && isLast {
+			c.db.logf("Discarded %d bytes of incomplete record at offset %d in segment %d: %v", stat.Size()-offset, offset, num, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: segment %d at offset %d: %v", ErrCorrupted, num, offset, err)
+		}
+		if err := c.add(key, value); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// readLegacyRecord reads one record of the original format, of which at most
+// left bytes remain in the segment.
+func readLegacyRecord(r *bufio.Reader, left int64) (key, value string, size int64, err error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", "", 0, err
+	}
+	size = int64(binary.LittleEndian.Uint32(header[:]))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	if size < legacyHeaderSize || kl > size-legacyHeaderSize {
+		return "", "", 0, fmt.Errorf("invalid record size %d", size)
+	}
+	if size > left {
+		return "", "", 0, io.ErrUnexpectedEOF
+	}
+	rest := make([]byte, size-8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return "", "", 0, err
+	}
+	vl := int64(binary.LittleEndian.Uint32(rest[kl:]))
+	if legacyHeaderSize+kl+vl != size {
+		return "", "", 0, fmt.Errorf("invalid record size %d", size)
+	}
+	return string(rest[:kl]), string(rest[kl+4:]), size, nil
+}
+
+// add writes a converted record the way the writer would.
+func (c *legacyConverter) add(key, value string) error {
+	if c.out == nil || c.offset >= c.db.opts.MaxSegmentSize {
+		if err := c.closeSegment(); err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(c.dir, segmentName(c.next)))
+		if err != nil {
+			return err
+		}
+		c.out, c.buf, c.offset = f, bufio.NewWriter(f), 0
+		c.nums = append(c.nums, c.next)
+		c.next++
+	}
+
+	c.versions[key]++
+	e := entry{key: key, value: value, version: c.versions[key]}
+	c.db.compressValue(&e)
+	c.db.keys.encrypt(&e)
+	data := e.Encode()
+	if _, err := c.buf.Write(data); err != nil {
+		return err
+	}
+	c.offset += int64(len(data))
+	return nil
+}
+
+// closeSegment flushes, syncs and closes the segment being written, if any.
+func (c *legacyConverter) closeSegment() error {
+	if c.out == nil {
+		return nil
+	}
+	err := c.buf.Flush()
+	if err == nil {
+		err = c.out.Sync()
+	}
+	if closeErr := c.out.Close(); err == nil {
+		err = closeErr
+	}
+	c.out = nil
+	return err
+}
@@ -0,0 +1,199 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifestName is the file listing the segments that make up the database.
+// Segment files not listed there are leftovers of an interrupted rollover or
+// compaction and are removed by Open.
+const manifestName = "MANIFEST"
+
+// Manifest layout:
+//
+// 0       4     8         12      16                     <-- offset
+// (magic) (crc) (version) (count) (segment numbers...)
+//
+// crc is the CRC32 (IEEE) of everything that follows it. version is the
+// format of the segments; the segment numbers, 4 bytes each, are listed from
+// the oldest segment to the active one.
+
+const (
+	manifestMagic      = "SEGM"
+	manifestHeaderSize = 16
+
+	// formatVersion is the format of the segments this package writes: the
+	// record layout in entry.go. Segments of the original format, written
+	// before there were manifests, are converted by Open, see legacy.go.
+	formatVersion = 1
+)
+
+func encodeManifest(nums []int) []byte {
+	res := make([]byte, manifestHeaderSize+4*len(nums))
+	copy(res, manifestMagic)
+	binary.LittleEndian.PutUint32(res[8:], formatVersion)
+	binary.LittleEndian.PutUint32(res[12:], uint32(len(nums)))
+	for i, num := range nums {
+		binary.LittleEndian.PutUint32(res[manifestHeaderSize+4*i:], uint32(num))
+	}
+	binary.LittleEndian.PutUint32(res[4:], crc32.ChecksumIEEE(res[8:]))
+	return res
+}
+
+func decodeManifest(data []byte) ([]int, error) {
+	if len(data) < len(manifestMagic) || string(data[:len(manifestMagic)]) != manifestMagic {
+		return nil, fmt.Errorf("%w: manifest written by an unknown version", ErrUnsupportedFormat)
+	}
+	if len(data) < manifestHeaderSize {
+		return nil, fmt.Errorf("%w: manifest too short", ErrCorrupted)
+	}
+	if crc32.ChecksumIEEE(data[8:]) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, fmt.Errorf("%w: manifest checksum mismatch", ErrCorrupted)
+	}
+	if version := binary.LittleEndian.Uint32(data[8:]); version != formatVersion {
+		return nil, fmt.Errorf("%w: format version %d, expected %d", ErrUnsupportedFormat, version, formatVersion)
+	}
+	count := int(binary.LittleEndian.Uint32(data[12:]))
+	if len(data) != manifestHeaderSize+4*count {
+		return nil, fmt.Errorf("%w: manifest size does not match its %d segments", ErrCorrupted, count)
+	}
+	nums := make([]int, count)
+	for i := range nums {
+		nums[i] = int(binary.LittleEndian.Uint32(data[manifestHeaderSize+4*i:]))
+	}
+	return nums, nil
+}
+
+func readManifest(dir string) ([]int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(data)
+}
+
+// writeManifest replaces the manifest atomically and durably, whatever the
+// sync policy: it is what makes a rollover or compaction take effect.
+func writeManifest(dir string, nums []int) error {
+	path := filepath.Join(dir, manifestName)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encodeManifest(nums)); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// saveManifest records the given segment list. Must be called with
+// db.manifestMu held, or during Open.
+func (db *Db) saveManifest(segments []*Segment) error {
+	nums := make([]int, len(segments))
+	for i, seg := range segments {
+		nums[i] = seg.num
+	}
+	if err := writeManifest(db.dir, nums); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// loadManifest returns the segment numbers to open, oldest first. A directory
+// without a manifest is either new or holds segments of the original format,
+// whose numbers are returned with legacy set for Open to convert them.
+func loadManifest(dir string) (nums []int, legacy bool, err error) {
+	nums, err = readManifest(dir)
+	if err == nil {
+		return nums, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, f := range files {
+		if num, ok := parseSegmentName(f.Name()); ok && isSegmentFile(f.Name()) {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	return nums, len(nums) > 0, nil
+}
+
+// removeOrphans deletes merge and temporary files, the files of segments not
+// listed in the manifest together with their hints, and whatever a finished
+// conversion left behind.
+func (db *Db) removeOrphans(nums []int) error {
+	dir := db.dir
+	live := make(map[int]bool, len(nums))
+	for _, num := range nums {
+		live[num] = true
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		num, ok := parseSegmentName(name)
+		if !ok {
+			continue
+		}
+		if live[num] && !strings.HasSuffix(name, mergeSuffix) && !strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to remove orphaned file %s: %w", name, err)
+		}
+		db.logf("Removed orphaned file %s", name)
+	}
+	return os.RemoveAll(filepath.Join(dir, convertDirName))
+}
+
+// parseSegmentName returns the number of the segment a segment, hint, merge
+// or temporary file belongs to.
+func parseSegmentName(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, segmentPrefix)
+	if !ok {
+		return 0, false
+	}
+	digits, _, _ := strings.Cut(rest, ".")
+	num, err := strconv.Atoi(digits)
+	if err != nil || num <= 0 {
+		return 0, false
+	}
+	return num, true
+}
+
+func segmentName(num int) string {
+	return fmt.Sprintf("%s%04d", segmentPrefix, num)
+}
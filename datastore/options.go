@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+// ErrReadOnly is returned by writes to a database opened with ReadOnly set.
+var ErrReadOnly = errors.New("database is read-only")
+
+// Options configures a database opened with OpenWithOptions. Zero values
+// select the defaults noted on the fields.
+type Options struct {
+	// MaxSegmentSize is the size at which the active segment is sealed and a
+	// new one started. It is required.
+	MaxSegmentSize int64
+
+	// GetWorkers is the number of goroutines reading values from segments.
+	// It defaults to twice the number of CPUs.
+	GetWorkers int
+	// QueueDepth is how many writes can wait for the writer before callers
+	// block. It defaults to 100.
+	QueueDepth int
+
+	// SyncPolicy and SyncInterval decide when writes are flushed to stable
+	// storage. See WithSyncPolicy.
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+
+	// CompressThreshold is the value size from which values are compressed.
+	// See WithCompression.
+	CompressThreshold int
+	// CacheSize bounds the value cache in bytes. See WithCache.
+	CacheSize int64
+	// DiskIndex keeps the keys of sealed segments on disk. See WithDiskIndex.
+	DiskIndex bool
+	// EncryptionKeys turn on encryption. See WithEncryption.
+	EncryptionKeys []EncryptionKey
+	// Compaction decides when the database compacts itself. See
+	// WithAutoCompaction.
+	Compaction CompactionPolicy
+
+	// Logger receives messages about recovery, compaction and failures of
+	// background work. It defaults to standard error.
+	Logger *log.Logger
+	// ReadOnly opens an existing database without changing anything on disk.
+	// Writes fail with ErrReadOnly, compaction is off, and a torn write at
+	// the end of the last segment is skipped rather than cut off.
+	ReadOnly bool
+}
+
+// Option adjusts the options Open sets up the database with.
+type Option func(*Options)
+
+// WithGetWorkers sets the number of goroutines reading values.
+func WithGetWorkers(n int) Option {
+	return func(o *Options) {
+		o.GetWorkers = n
+	}
+}
+
+// WithQueueDepth sets how many writes can be queued for the writer.
+func WithQueueDepth(n int) Option {
+	return func(o *Options) {
+		o.QueueDepth = n
+	}
+}
+
+// WithLogger sends the database's messages to logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// WithReadOnly opens the database read-only. See Options.ReadOnly.
+func WithReadOnly() Option {
+	return func(o *Options) {
+		o.ReadOnly = true
+	}
+}
+
+// Validate reports the first option that is out of range.
+func (o *Options) Validate() error {
+	if o.MaxSegmentSize <= 0 {
+		return fmt.Errorf("max segment size must be positive, got %d", o.MaxSegmentSize)
+	}
+	if o.GetWorkers < 0 {
+		return fmt.Errorf("get workers must not be negative, got %d", o.GetWorkers)
+	}
+	if o.QueueDepth < 0 {
+		return fmt.Errorf("queue depth must not be negative, got %d", o.QueueDepth)
+	}
+	for _, validate := range []func() error{
+		o.validateSyncPolicy,
+		o.validateCompression,
+		o.validateCompactionPolicy,
+		o.validateCache,
+	} {
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o Options) withDefaults() Options {
+	if o.GetWorkers == 0 {
+		o.GetWorkers = runtime.NumCPU() * 2
+	}
+	if o.QueueDepth == 0 {
+		o.QueueDepth = 100
+	}
+	if o.Logger == nil {
+		o.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return o
+}
+
+func (db *Db) logf(format string, args ...any) {
+	db.opts.Logger.Printf(format, args...)
+}
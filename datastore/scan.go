@@ -0,0 +1,96 @@
+package datastore
+
+// Iterator walks keys in ascending order together with their values. It reads
+// from a snapshot, so writes made while iterating do not show up in it.
+type Iterator struct {
+	snap *Snapshot
+	// ownsSnap is set when the iterator took the snapshot itself and has to
+	// release it once done.
+	ownsSnap bool
+	cursor   *mergeCursor
+	end      string
+	limit    int
+	count    int
+
+	key, value string
+	err        error
+}
+
+// Scan iterates over keys in [start, end). An empty end means no upper bound
+// and a non-positive limit means no limit on the number of keys. The iterator
+// must be closed if it is abandoned before Next returns false.
+func (db *Db) Scan(start, end string, limit int) *Iterator {
+	it := db.Snapshot().Scan(start, end, limit)
+	it.ownsSnap = true
+	return it
+}
+
+// ScanPrefix iterates over all keys starting with prefix.
+func (db *Db) ScanPrefix(prefix string) *Iterator {
+	return db.Scan(prefix, PrefixEnd(prefix), 0)
+}
+
+// PrefixEnd returns the smallest key greater than every key with the given
+// prefix, or "" if there is none.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for len(end) > 0 {
+		last := len(end) - 1
+		if end[last] < 0xff {
+			end[last]++
+			return string(end[:last+1])
+		}
+		end = end[:last]
+	}
+	return ""
+}
+
+// Next advances to the next key and reports whether there is one. It returns
+// false once the range is exhausted or reading a value failed; Err tells the
+// two apart.
+func (it *Iterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.count >= it.limit) {
+		it.Close()
+		return false
+	}
+	n, ok := it.cursor.next()
+	for ok && (n.pos.deleted || n.pos.expired(it.snap.createdAt)) {
+		n, ok = it.cursor.next()
+	}
+	if !ok || (it.end != "" && n.key >= it.end) {
+		it.err = it.cursor.err()
+		it.Close()
+		return false
+	}
+
+	value, err := it.snap.read(n.key, n.pos)
+	if err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+
+	it.key, it.value = n.key, value
+	it.count++
+	return true
+}
+
+// Close releases the resources held by the iterator. It is safe to call more
+// than once.
+func (it *Iterator) Close() {
+	if it.ownsSnap {
+		it.snap.Release()
+	}
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
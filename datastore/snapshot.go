@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Snapshot is a read-only view of the database as of the moment it was taken.
+// It keeps the segments it refers to alive, so Release must be called once
+// the snapshot is no longer needed, and before the database is closed.
+type Snapshot struct {
+	db       *Db
+	keys     keyTable
+	segments []*Segment
+	// createdAt is the Unix time in nanoseconds the snapshot was taken at.
+	// Keys that expire later are still in the snapshot.
+	createdAt int64
+
+	releaseOnce sync.Once
+}
+
+func (db *Db) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.snapshotLocked()
+}
+
+// snapshotLocked takes a snapshot. Must be called with db.mu held.
+func (db *Db) snapshotLocked() *Snapshot {
+	snap := &Snapshot{
+		db:        db,
+		keys:      db.keyTable(),
+		segments:  append([]*Segment(nil), db.segments...),
+		createdAt: time.Now().UnixNano(),
+	}
+	for _, seg := range snap.segments {
+		seg.acquire()
+	}
+	return snap
+}
+
+func (s *Snapshot) Get(key string) (string, error) {
+	s.db.ops.gets.Add(1)
+	value, _, err := s.getVersioned(key)
+	return value, err
+}
+
+func (s *Snapshot) getVersioned(key string) (string, uint64, error) {
+	pos, ok, err := s.keys.get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if !ok || pos.expired(s.createdAt) {
+		return "", 0, ErrNotFound
+	}
+	value, err := s.read(key, pos)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, pos.version, nil
+}
+
+// Scan iterates over keys in [start, end) as they were when the snapshot was
+// taken. See Db.Scan.
+func (s *Snapshot) Scan(start, end string, limit int) *Iterator {
+	s.db.ops.scans.Add(1)
+	return &Iterator{
+		snap:   s,
+		cursor: s.keys.seek(start),
+		end:    end,
+		limit:  limit,
+	}
+}
+
+func (s *Snapshot) ScanPrefix(prefix string) *Iterator {
+	return s.Scan(prefix, PrefixEnd(prefix), 0)
+}
+
+func (s *Snapshot) Release() {
+	s.releaseOnce.Do(func() {
+		for _, seg := range s.segments {
+			if err := seg.release(); err != nil {
+				s.db.logf("Error releasing snapshot segment: %v", err)
+			}
+		}
+		s.segments = nil
+	})
+}
+
+func (s *Snapshot) read(key string, pos SegmentPos) (string, error) {
+	if seg := s.segment(pos.segmentNum); seg != nil {
+		return s.db.readValue(key, pos, seg)
+	}
+	return "", fmt.Errorf("segment %d for key %s not found in snapshot", pos.segmentNum, key)
+}
+
+func (s *Snapshot) segment(num int) *Segment {
+	for _, seg := range s.segments {
+		if seg.num == num {
+			return seg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes the database at the moment Db.Stats was called.
+type Stats struct {
+	// Keys is the number of keys that have not been deleted. Expired keys
+	// are counted until a compaction drops them or, without the disk index,
+	// a restart.
+	Keys int
+	// SegmentCount is the number of segments, the active one included.
+	SegmentCount int
+	// Segments are ordered from the oldest segment to the active one.
+	Segments []SegmentStats
+	// LiveBytes is the size of the latest records of all keys and
+	// GarbageBytes the size of everything else in the segments. Like Keys,
+	// LiveBytes includes expired records not dropped yet.
+	LiveBytes    int64
+	GarbageBytes int64
+
+	// PendingWrites is the number of writes waiting for the writer.
+	PendingWrites int
+	// GetWorkers is the number of goroutines reading values and
+	// BusyGetWorkers how many of them are reading one right now.
+	GetWorkers     int
+	BusyGetWorkers int
+
+	Compaction CompactionStats
+	Ops        OpStats
+	Cache      CacheStats
+}
+
+// SegmentStats describes one segment.
+type SegmentStats struct {
+	Num       int
+	Size      int64
+	LiveBytes int64
+	Active    bool
+}
+
+// CompactionStats describes the most recent compaction. All fields stay zero
+// until the first one starts.
+type CompactionStats struct {
+	Running bool
+	// LastStarted is when the most recent compaction started.
+	LastStarted time.Time
+	// LastDuration and LastError describe the most recent compaction that
+	// finished. LastError is empty if it succeeded.
+	LastDuration time.Duration
+	LastError    string
+}
+
+// OpStats counts the operations made since Open. Writes are counted once the
+// writer has answered them; conditional puts count as puts.
+type OpStats struct {
+	Gets       uint64
+	Scans      uint64
+	Puts       uint64
+	Deletes    uint64
+	Batches    uint64
+	Increments uint64
+	// FailedWrites counts the writes that returned an error, including
+	// conditional writes whose condition did not hold.
+	FailedWrites uint64
+}
+
+type opCounters struct {
+	gets, scans, puts, deletes, batches, increments, failedWrites atomic.Uint64
+}
+
+func (c *opCounters) countWrite(req putRequest, err error) {
+	switch {
+	case err != nil:
+		c.failedWrites.Add(1)
+	case req.batch != nil:
+		c.batches.Add(1)
+	case req.incr != nil:
+		c.increments.Add(1)
+	case req.deleted:
+		c.deletes.Add(1)
+	default:
+		c.puts.Add(1)
+	}
+}
+
+func (c *opCounters) stats() OpStats {
+	return OpStats{
+		Gets:         c.gets.Load(),
+		Scans:        c.scans.Load(),
+		Puts:         c.puts.Load(),
+		Deletes:      c.deletes.Load(),
+		Batches:      c.batches.Load(),
+		Increments:   c.increments.Load(),
+		FailedWrites: c.failedWrites.Load(),
+	}
+}
+
+// Stats returns counters and sizes describing the database.
+func (db *Db) Stats() (Stats, error) {
+	db.mu.Lock()
+	stats := Stats{
+		Keys:          db.keyCount,
+		SegmentCount:  len(db.segments),
+		Segments:      make([]SegmentStats, len(db.segments)),
+		PendingWrites: len(db.putRequests),
+	}
+	for i, seg := range db.segments {
+		stats.Segments[i] = SegmentStats{
+			Num:       seg.num,
+			Size:      seg.offset,
+			LiveBytes: seg.liveBytes,
+			Active:    i == len(db.segments)-1,
+		}
+		stats.LiveBytes += seg.liveBytes
+		stats.GarbageBytes += seg.offset - seg.liveBytes
+	}
+	db.mu.Unlock()
+
+	stats.GetWorkers = db.opts.GetWorkers
+	stats.BusyGetWorkers = int(db.busyGetWorkers.Load())
+
+	db.compactionMu.Lock()
+	stats.Compaction = CompactionStats{
+		Running:      db.isCompacting,
+		LastStarted:  db.lastCompaction,
+		LastDuration: db.lastCompactionDuration,
+	}
+	if db.lastCompactionErr != nil {
+		stats.Compaction.LastError = db.lastCompactionErr.Error()
+	}
+	db.compactionMu.Unlock()
+
+	stats.Ops = db.ops.stats()
+	stats.Cache = db.cache.stats()
+	return stats, nil
+}
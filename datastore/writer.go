@@ -0,0 +1,326 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// writerGoroutine is the only place where records are appended. It commits
+// requests in groups: whatever is queued while the previous group was being
+// written goes out in one write and, under SyncAlways, one fsync.
+func (db *Db) writerGoroutine() {
+	defer db.writerWg.Done()
+	if db.opts.ReadOnly {
+		for req := range db.putRequests {
+			db.ops.countWrite(req, ErrReadOnly)
+			req.respCh <- ErrReadOnly
+		}
+		return
+	}
+	for req := range db.putRequests {
+		group := []putRequest{req}
+	drain:
+		for {
+			select {
+			case next, ok := <-db.putRequests:
+				if !ok {
+					break drain
+				}
+				group = append(group, next)
+			default:
+				break drain
+			}
+		}
+
+		// Key files are searched before db.mu is taken, so that readers are
+		// not held up by the disk reads.
+		var prefetched *sealedLookups
+		if db.opts.DiskIndex {
+			var keys []string
+			for _, req := range group {
+				keys = append(keys, req.keys()...)
+			}
+			prefetched = db.prefetchSealed(keys)
+		}
+
+		db.manifestMu.Lock()
+		db.mu.Lock()
+		db.prefetched = prefetched
+		errs := db.commitGroup(group)
+		db.prefetched = nil
+		db.mu.Unlock()
+		db.manifestMu.Unlock()
+
+		for i, req := range group {
+			db.ops.countWrite(req, errs[i])
+			req.respCh <- errs[i]
+		}
+
+		db.maybeCompact()
+	}
+}
+
+// indexUndo remembers what a staged record replaced in the index so the
+// change can be reverted if the write fails.
+type indexUndo struct {
+	key     string
+	pos     SegmentPos
+	existed bool
+}
+
+// stagedWrite collects encoded records destined for the active segment until
+// they are flushed together.
+type stagedWrite struct {
+	buf   []byte
+	hints []hintEntry
+	undo  []indexUndo
+	reqs  []int
+}
+
+// commitGroup stages the records of all requests and flushes them with as few
+// writes as possible. The index is updated while staging, so later requests in
+// the group see the effect of earlier ones; a failed flush rolls it back and
+// fails every request staged with it. Must be called with db.manifestMu and
+// db.mu held; a rollover releases db.mu for a while.
+func (db *Db) commitGroup(group []putRequest) []error {
+	errs := make([]error, len(group))
+	var stage stagedWrite
+
+	for i, req := range group {
+		if req.readsCurrentValue() {
+			// The current value may still sit in the stage, where it cannot
+			// be read back from the segment.
+			db.flush(&stage, errs)
+		}
+		records, err := db.requestRecords(req)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		// Records of one request never span segments, so a batch is always
+		// written by a single flush.
+		activeSeg := db.getActiveSegment()
+		if activeSeg.offset+int64(len(stage.buf)) >= db.opts.MaxSegmentSize {
+			db.flush(&stage, errs)
+			if err := db.rollover(); err != nil {
+				errs[i] = err
+				continue
+			}
+			activeSeg = db.getActiveSegment()
+		}
+
+		for _, e := range records {
+			offset := activeSeg.offset + int64(len(stage.buf))
+			db.compressValue(&e)
+			prev, existed := db.index.get(e.key)
+			stage.undo = append(stage.undo, indexUndo{key: e.key, pos: prev, existed: existed})
+			record := e
+			db.keys.encrypt(&record)
+			data := record.Encode()
+			size := int64(len(data))
+			if e.deleted {
+				db.indexDelete(e.key)
+			} else {
+				db.indexSet(e.key, SegmentPos{segmentNum: activeSeg.num, offset: offset, expiresAt: e.expiresAt, version: e.version, size: size})
+			}
+			stage.buf = append(stage.buf, data...)
+			stage.hints = append(stage.hints, hintEntry{key: e.key, offset: offset, size: size, deleted: e.deleted, expiresAt: e.expiresAt, version: e.version})
+		}
+		stage.reqs = append(stage.reqs, i)
+	}
+
+	db.flush(&stage, errs)
+	return errs
+}
+
+// requestRecords returns the records a request appends, with their versions
+// set. Must be called with db.mu held.
+func (db *Db) requestRecords(req putRequest) ([]entry, error) {
+	records, err := db.unversionedRecords(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.assignVersions(records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (db *Db) unversionedRecords(req putRequest) ([]entry, error) {
+	if req.batch != nil {
+		return db.batchRecords(req.batch)
+	}
+	if req.deleted {
+		exists, err := db.exists(req.key)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrNotFound
+		}
+	}
+	if req.incr != nil {
+		return db.incrementRecords(req.key, req.incr)
+	}
+	if err := db.checkCondition(req.key, req.cond); err != nil {
+		return nil, err
+	}
+	return []entry{{key: req.key, value: req.value, deleted: req.deleted, isInt64: req.isInt64, expiresAt: req.expiresAt}}, nil
+}
+
+// assignVersions gives every record the version following the one of the
+// record it replaces. Looking versions up before anything is staged keeps a
+// failed lookup from leaving part of a batch behind. Must be called with
+// db.mu held.
+func (db *Db) assignVersions(records []entry) error {
+	versions := make(map[string]uint64, len(records))
+	for i := range records {
+		key := records[i].key
+		version, seen := versions[key]
+		if !seen {
+			var err error
+			if version, err = db.currentVersion(key); err != nil {
+				return err
+			}
+		}
+		records[i].version = version + 1
+		if records[i].deleted {
+			// A deleted key starts over at version 1.
+			versions[key] = 0
+		} else {
+			versions[key] = version + 1
+		}
+	}
+	return nil
+}
+
+// exists reports whether the key is present and not expired. Must be called
+// with db.mu held.
+func (db *Db) exists(key string) (bool, error) {
+	pos, ok, err := db.lookup(key)
+	return ok && !pos.expired(time.Now().UnixNano()), err
+}
+
+// flush writes the staged records to the active segment and resets the stage.
+func (db *Db) flush(stage *stagedWrite, errs []error) {
+	if len(stage.buf) == 0 {
+		return
+	}
+	defer func() {
+		*stage = stagedWrite{buf: stage.buf[:0]}
+	}()
+
+	activeSeg := db.getActiveSegment()
+	err := db.writeSegment(activeSeg, stage.buf)
+	if err != nil {
+		for i := len(stage.undo) - 1; i >= 0; i-- {
+			db.indexRestore(stage.undo[i])
+		}
+		for _, i := range stage.reqs {
+			errs[i] = err
+		}
+		return
+	}
+
+	activeSeg.hints = append(activeSeg.hints, stage.hints...)
+	activeSeg.offset += int64(len(stage.buf))
+}
+
+// writeSegment appends data to the segment honouring the sync policy. Data
+// that was not written or synced in full is cut off again: the file is
+// appended to, so later records would otherwise end up behind it while their
+// offsets are counted from seg.offset, and a restart would bring back writes
+// reported as failed.
+func (db *Db) writeSegment(seg *Segment, data []byte) error {
+	if _, err := seg.file.Write(data); err != nil {
+		return truncateFailedWrite(seg, err)
+	}
+	if db.opts.SyncPolicy == SyncAlways {
+		if err := seg.file.Sync(); err != nil {
+			return truncateFailedWrite(seg, fmt.Errorf("failed to sync segment %d: %w", seg.num, err))
+		}
+	} else {
+		db.dirty = true
+	}
+	return nil
+}
+
+func truncateFailedWrite(seg *Segment, err error) error {
+	if truncErr := seg.file.Truncate(seg.offset); truncErr != nil {
+		return fmt.Errorf("%w (truncating segment %d back also failed: %v)", err, seg.num, truncErr)
+	}
+	return err
+}
+
+// rollover seals the active segment and starts a new one. The new segment
+// only becomes part of the database once the manifest lists it. Must be
+// called with db.mu held, which is released while the files are written: the
+// stage has been flushed and the writer holds db.manifestMu, so neither the
+// index nor the segment list changes meanwhile.
+func (db *Db) rollover() error {
+	activeSeg := db.getActiveSegment()
+	newSeg, err := createNewSegment(db.dir, db.nextSegmentNum)
+	if err != nil {
+		return err
+	}
+	db.nextSegmentNum++
+	segments := append(db.segments[:len(db.segments):len(db.segments)], newSeg)
+	index := db.index
+
+	db.mu.Unlock()
+	keys, err := db.sealFiles(activeSeg, index, segments)
+	db.mu.Lock()
+	if err != nil {
+		db.discardSegment(newSeg)
+		return err
+	}
+	if keys != nil {
+		activeSeg.keys = keys
+		db.index = keyIndex{}
+	}
+	db.segments = segments
+	db.segmentsGen++
+	return nil
+}
+
+// sealFiles writes what a segment needs once sealed and the manifest listing
+// the new segment list. Under the disk index the keys of the sealed segment
+// move from index to its key file, which therefore has to be written first.
+func (db *Db) sealFiles(sealed *Segment, index keyIndex, segments []*Segment) (*keyFile, error) {
+	if err := db.syncRollover(sealed); err != nil {
+		return nil, err
+	}
+	var keys *keyFile
+	if db.opts.DiskIndex {
+		var err error
+		if keys, err = writeKeyFile(sealed, index.seek(""), db.keys); err != nil {
+			return nil, fmt.Errorf("failed to write key file for segment %d: %w", sealed.num, err)
+		}
+	}
+	if err := db.saveManifest(segments); err != nil {
+		if keys != nil {
+			keys.close()
+			os.Remove(keysPath(sealed.file.Name()))
+		}
+		return nil, err
+	}
+	db.sealSegment(sealed)
+	return keys, nil
+}
+
+// syncRollover makes sure nothing written to the segment being sealed is
+// left unflushed, whatever the sync policy: recovery only forgives a torn
+// write in the last segment, and the manifest that makes the new segment the
+// last one is always written durably. The new segment file is made durable by
+// the manifest update.
+func (db *Db) syncRollover(sealed *Segment) error {
+	if err := sealed.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment %d: %w", sealed.num, err)
+	}
+	return nil
+}